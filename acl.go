@@ -0,0 +1,153 @@
+package kcp
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var rejectedConns = newCounterVec("listener_rejected_connections_total",
+	"Connections refused by a listener's allow and deny lists.")
+
+// addrFilter is the source address policy of a listener, deny wins over
+// allow and an empty allow list lets everyone else in. Unix socket peers
+// have no address and are always let in.
+type addrFilter struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	proxies []*net.IPNet // the peers a PROXY header is taken from, empty for any admitted peer
+}
+
+// parseCIDRs parses CIDRs or bare addresses, which match only themselves
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("%q is not an address or CIDR", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// newAddrFilter returns nil, which admits and trusts everyone, when all the
+// lists are empty
+func newAddrFilter(allow, deny, proxies []string) (*addrFilter, error) {
+	f := new(addrFilter)
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, errors.Wrap(err, "allow")
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, errors.Wrap(err, "deny")
+	}
+	if f.proxies, err = parseCIDRs(proxies); err != nil {
+		return nil, errors.Wrap(err, "proxies")
+	}
+	if len(f.allow) == 0 && len(f.deny) == 0 && len(f.proxies) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func matchAny(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP is the ip of a tcp or udp address, nil for others
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (f *addrFilter) permit(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if f == nil || ip == nil {
+		return true
+	}
+	if matchAny(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || matchAny(f.allow, ip)
+}
+
+// trusts reports whether a PROXY header from addr is taken, any admitted
+// peer is trusted when there is no proxies list
+func (f *addrFilter) trusts(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if f == nil || len(f.proxies) == 0 || ip == nil {
+		return true
+	}
+	return matchAny(f.proxies, ip)
+}
+
+// serveAccepted hands conn to handle in a goroutine once f admits it. With
+// acceptProxy f checks the load balancer that connected and whether it is
+// trusted, then reads the PROXY header and checks the client it reports as
+// well.
+func (f *addrFilter) serveAccepted(conn net.Conn, component string, acceptProxy bool, handle func(conn net.Conn)) {
+	if !f.admit(conn, component) {
+		return
+	}
+	if !acceptProxy {
+		go handle(conn)
+		return
+	}
+	if !f.trusts(conn.RemoteAddr()) {
+		log.Println(component+": PROXY header from untrusted peer", conn.RemoteAddr())
+		rejectedConns.inc(labels("component", component))
+		conn.Close()
+		return
+	}
+	go func() {
+		pconn, err := readProxyHeader(conn)
+		if err != nil {
+			log.Println(component+":", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if f.admit(pconn, component) {
+			handle(pconn)
+		}
+	}()
+}
+
+// admit checks a connection accepted by the listener named component, a
+// rejected one is logged, counted and closed
+func (f *addrFilter) admit(conn net.Conn, component string) bool {
+	if f.permit(conn.RemoteAddr()) {
+		return true
+	}
+	log.Println(component+": rejected connection from", conn.RemoteAddr())
+	rejectedConns.inc(labels("component", component))
+	conn.Close()
+	return false
+}
@@ -0,0 +1,153 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddrFilter(t *testing.T) {
+	f, err := newAddrFilter([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}, []string{"10.1.0.0/16"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.2.3":    false, // deny wins
+		"192.0.2.1":   true,
+		"192.0.2.2":   false, // a bare address matches only itself
+		"2001:db8::1": true,
+		"127.0.0.1":   false,
+	} {
+		if got := f.permit(&net.TCPAddr{IP: net.ParseIP(ip)}); got != want {
+			t.Errorf("permit(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if !f.permit(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("a unix socket peer was refused")
+	}
+}
+
+func TestNewAddrFilterEmpty(t *testing.T) {
+	f, err := newAddrFilter([]string{""}, nil, nil)
+	if f != nil || err != nil {
+		t.Errorf("newAddrFilter() = %v, %v, want nil for no lists", f, err)
+	}
+	if !f.permit(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("a nil filter refused a client")
+	}
+	if _, err := newAddrFilter([]string{"example.com"}, nil, nil); err == nil {
+		t.Error("newAddrFilter() accepted a host name")
+	}
+	if _, err := newAddrFilter(nil, []string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("newAddrFilter() accepted a bad CIDR")
+	}
+}
+
+// proxiedConn is the server end of a loopback connection that starts with a
+// PROXY header claiming to come from src
+func proxiedConn(t *testing.T, src string) net.Conn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Write([]byte("PROXY TCP4 " + src + " 127.0.0.1 40000 1080\r\n"))
+	server, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// serveOne runs serveAccepted on conn and reports the remote address the
+// handler saw, nil if conn was refused
+func serveOne(f *addrFilter, conn net.Conn, acceptProxy bool) net.Addr {
+	handled := make(chan net.Addr, 1)
+	f.serveAccepted(conn, "test", acceptProxy, func(conn net.Conn) {
+		handled <- conn.RemoteAddr()
+		conn.Close()
+	})
+	select {
+	case addr := <-handled:
+		return addr
+	case <-time.After(500 * time.Millisecond):
+		return nil
+	}
+}
+
+// behind a load balancer both the balancer and the client its PROXY header
+// reports must pass the filter
+func TestServeAcceptedProxy(t *testing.T) {
+	f, err := newAddrFilter([]string{"127.0.0.1", "192.0.2.0/24"}, []string{"192.0.2.66"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for src, want := range map[string]bool{"192.0.2.7": true, "192.0.2.66": false, "198.51.100.7": false} {
+		addr := serveOne(f, proxiedConn(t, src), true)
+		if !want {
+			if addr != nil {
+				t.Errorf("client %s behind the balancer was admitted", src)
+			}
+		} else if addr == nil || addr.(*net.TCPAddr).IP.String() != src {
+			t.Errorf("client %s: handler saw %v", src, addr)
+		}
+	}
+}
+
+// a header can't get a denied peer past the filter
+func TestServeAcceptedDeniedBalancer(t *testing.T) {
+	f, err := newAddrFilter([]string{"192.0.2.0/24"}, []string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := serveOne(f, proxiedConn(t, "192.0.2.7"), true); addr != nil {
+		t.Errorf("a denied balancer got in claiming %v", addr)
+	}
+}
+
+func TestServeAcceptedTrustedProxies(t *testing.T) {
+	f, err := newAddrFilter(nil, nil, []string{"192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := serveOne(f, proxiedConn(t, "198.51.100.7"), true); addr != nil {
+		t.Errorf("a header from an untrusted peer was taken: %v", addr)
+	}
+	// without acceptProxy the list doesn't matter
+	if addr := serveOne(f, proxiedConn(t, "198.51.100.7"), false); addr == nil {
+		t.Error("a direct client was refused")
+	}
+
+	f, err = newAddrFilter(nil, nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := serveOne(f, proxiedConn(t, "198.51.100.7"), true); addr == nil || addr.(*net.TCPAddr).IP.String() != "198.51.100.7" {
+		t.Errorf("a trusted balancer's client: handler saw %v", addr)
+	}
+	if _, err := newAddrFilter(nil, nil, []string{"lb.example.com"}); err == nil {
+		t.Error("newAddrFilter() accepted a proxy host name")
+	}
+}
+
+func TestServeAcceptedDirect(t *testing.T) {
+	f, err := newAddrFilter(nil, []string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{}, 1)
+	f.serveAccepted(proxiedConn(t, "192.0.2.7"), "test", false, func(conn net.Conn) {
+		handled <- struct{}{}
+	})
+	select {
+	case <-handled:
+		t.Error("a denied client was admitted without acceptProxy")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
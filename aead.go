@@ -0,0 +1,329 @@
+package kcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Shadowsocks AEAD ciphers, SIP004. Every connection and every udp packet
+// starts with a random salt, the session key is HKDF-SHA1 of the master key
+// and the salt. Streams are chunks of a sealed 2 byte length and a sealed
+// payload with a little endian counter nonce, packets are sealed whole with a
+// zero nonce.
+
+const (
+	aeadMaxPayload = 0x3fff
+	aeadInfo       = "ss-subkey"
+	aeadTagSize    = 16 // the overhead of every cipher in aeadCiphers
+)
+
+var (
+	errSSPacket    = errors.New("shadowsocks packet malformed")
+	errAEADPayload = errors.New("shadowsocks aead payload too large")
+)
+
+var aeadCiphers = map[string]struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}{
+	"aes-128-gcm":             {16, newGCM},
+	"aes-256-gcm":             {32, newGCM},
+	"chacha20-ietf-poly1305":  {32, chacha20poly1305.New},
+	"xchacha20-ietf-poly1305": {32, chacha20poly1305.NewX},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ssCipher reaches a shadowsocks server, with a stream cipher of ss or an
+// AEAD one
+type ssCipher interface {
+	// dial connects to server and sends the socks address rawaddr
+	dial(rawaddr []byte, server string) (net.Conn, error)
+	// packetConn encrypts the packets on pc, ota is for stream ciphers only
+	packetConn(pc net.PacketConn, ota bool) packetCipher
+}
+
+// packetCipher is a shadowsocks udp socket, payloads start with the socks
+// address of the target
+type packetCipher interface {
+	net.PacketConn
+	// open decrypts a packet read from the underlying socket
+	open(b []byte) ([]byte, error)
+}
+
+// newCipher returns the cipher for method, the AEAD ones or whatever ss
+// supports
+func newCipher(method, password string) (ssCipher, error) {
+	if a, ok := aeadCiphers[method]; ok {
+		c := &aeadCipher{key: evpBytesToKey(password, a.keySize), newAEAD: a.newAEAD}
+		// reject a bad key now rather than on the first connection
+		if _, err := c.newAEAD(c.key); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c, err := ss.NewCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return streamCipher{c}, nil
+}
+
+func isAEAD(method string) bool {
+	_, ok := aeadCiphers[method]
+	return ok
+}
+
+// evpBytesToKey is OpenSSL's EVP_BytesToKey with md5 and no salt, the master
+// key of every shadowsocks cipher
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+type streamCipher struct {
+	*ss.Cipher
+}
+
+func (c streamCipher) dial(rawaddr []byte, server string) (net.Conn, error) {
+	return ss.DialWithRawAddr(rawaddr, server, c.Copy())
+}
+
+func (c streamCipher) packetConn(pc net.PacketConn, ota bool) packetCipher {
+	return streamPacketConn{ss.NewSecurePacketConn(pc, c.Copy(), ota)}
+}
+
+type streamPacketConn struct {
+	*ss.SecurePacketConn
+}
+
+func (c streamPacketConn) open(b []byte) ([]byte, error) {
+	plain, n := c.ParseReadData(b)
+	if n <= 0 || n > len(plain) {
+		return nil, errSSPacket
+	}
+	return plain[:n], nil
+}
+
+type aeadCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func (c *aeadCipher) saltSize() int {
+	return len(c.key)
+}
+
+// subkey is the key of one connection or packet, derived from its salt
+func (c *aeadCipher) subkey(salt []byte) ([]byte, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte(aeadInfo)), subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// session derives the AEAD of one connection or packet from its salt
+func (c *aeadCipher) session(salt []byte) (cipher.AEAD, error) {
+	subkey, err := c.subkey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+func (c *aeadCipher) dial(rawaddr []byte, server string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", server, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ac := &aeadConn{Conn: conn, c: c}
+	if _, err := ac.Write(rawaddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ac, nil
+}
+
+func (c *aeadCipher) packetConn(pc net.PacketConn, _ bool) packetCipher {
+	return &aeadPacketConn{PacketConn: pc, c: c}
+}
+
+// aeadConn is a shadowsocks AEAD stream, each direction gets its salt on its
+// first bytes
+type aeadConn struct {
+	net.Conn
+	c        *aeadCipher
+	enc, dec cipher.AEAD
+	encNonce []byte
+	decNonce []byte
+	buf      []byte // sealed chunk being read
+	pending  []byte // decrypted bytes not read yet
+}
+
+// increment adds one to a little endian nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *aeadConn) Write(b []byte) (int, error) {
+	var out []byte
+	if c.enc == nil {
+		salt := make([]byte, c.c.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		enc, err := c.c.session(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc, c.encNonce = enc, make([]byte, enc.NonceSize())
+		out = salt
+	}
+	for p := b; len(p) > 0; {
+		n := len(p)
+		if n > aeadMaxPayload {
+			n = aeadMaxPayload
+		}
+		out = c.enc.Seal(out, c.encNonce, []byte{byte(n >> 8), byte(n)}, nil)
+		increment(c.encNonce)
+		out = c.enc.Seal(out, c.encNonce, p[:n], nil)
+		increment(c.encNonce)
+		p = p[n:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *aeadConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readChunk decrypts the next chunk into pending
+func (c *aeadConn) readChunk() error {
+	if c.dec == nil {
+		salt := make([]byte, c.c.saltSize())
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		dec, err := c.c.session(salt)
+		if err != nil {
+			return err
+		}
+		c.dec, c.decNonce = dec, make([]byte, dec.NonceSize())
+		c.buf = make([]byte, aeadMaxPayload+dec.Overhead())
+	}
+	overhead := c.dec.Overhead()
+	sealed := c.buf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	size, err := c.dec.Open(sealed[:0], c.decNonce, sealed, nil)
+	if err != nil {
+		return err
+	}
+	increment(c.decNonce)
+	n := int(binary.BigEndian.Uint16(size))
+	if n > aeadMaxPayload {
+		return errAEADPayload
+	}
+	sealed = c.buf[:n+overhead]
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	c.pending, err = c.dec.Open(sealed[:0], c.decNonce, sealed, nil)
+	if err != nil {
+		return err
+	}
+	increment(c.decNonce)
+	return nil
+}
+
+// aeadPacketConn seals every packet on its own with a fresh salt
+type aeadPacketConn struct {
+	net.PacketConn
+	c *aeadCipher
+}
+
+func (c *aeadPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	salt := make([]byte, c.c.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.c.session(salt)
+	if err != nil {
+		return 0, err
+	}
+	out := aead.Seal(salt, make([]byte, aead.NonceSize()), b, nil)
+	if _, err := c.PacketConn.WriteTo(out, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *aeadPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, MAX_UDPBUF+c.c.saltSize()+aeadTagSize)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		// drop what does not decrypt like a socket would drop garbage
+		if plain, err := c.open(buf[:n]); err == nil {
+			return copy(b, plain), addr, nil
+		}
+	}
+}
+
+func (c *aeadPacketConn) open(b []byte) ([]byte, error) {
+	saltSize := c.c.saltSize()
+	if len(b) < saltSize {
+		return nil, errSSPacket
+	}
+	aead, err := c.c.session(b[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < saltSize+aead.Overhead() {
+		return nil, errSSPacket
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), b[saltSize:], nil)
+}
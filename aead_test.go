@@ -0,0 +1,186 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// the vectors were sealed by go-shadowsocks2 with the password below, the
+// keys come from openssl enc -md md5 -nosalt -P and the subkeys from an
+// HKDF-SHA1 checked against RFC 5869
+const aeadTestPassword = "shadowsocks test"
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEVPBytesToKey(t *testing.T) {
+	for _, c := range []struct {
+		password string
+		keyLen   int
+		want     string
+	}{
+		{"foobar", 32, "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"},
+		{aeadTestPassword, 16, "dc04fd52c7300322e0fdb96ffb6e2983"},
+		{aeadTestPassword, 32, "dc04fd52c7300322e0fdb96ffb6e29832e3739874a83d6a21b0f94ed79a5c684"},
+	} {
+		if got := hex.EncodeToString(evpBytesToKey(c.password, c.keyLen)); got != c.want {
+			t.Errorf("evpBytesToKey(%q, %d) = %s, want %s", c.password, c.keyLen, got, c.want)
+		}
+	}
+}
+
+func TestAEADSubkey(t *testing.T) {
+	for _, c := range []struct {
+		method string
+		salt   string
+		want   string
+	}{
+		{"aes-128-gcm", "52d694c66f88095f5e9ba62be8097664", "471d992c67eea6386d96f364cabab435"},
+		{"aes-256-gcm", "7d864f1d6a42f9bffd8a549c3bf9aff11ade7ec815cd9adf21b92c2679f4364c", "ba18f228b6a28b5cb9dc4f4cb026a21fcdbc2a36b8a93ce893657d000821e5cc"},
+	} {
+		cipher, err := newCipher(c.method, aeadTestPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subkey, err := cipher.(*aeadCipher).subkey(unhex(t, c.salt))
+		if err != nil || hex.EncodeToString(subkey) != c.want {
+			t.Errorf("%s: subkey = %x, %v, want %s", c.method, subkey, err, c.want)
+		}
+	}
+}
+
+var aeadVectors = []struct {
+	method string
+	udp    string
+	tcp    string
+}{
+	{
+		"aes-128-gcm",
+		"52d694c66f88095f5e9ba62be809766472455ea21d731601be2bd7024e0d798b7ba7020f2fddcfb4b37f61e2afb52020be",
+		"acb91a8769910499fc5b56f7256f4bb776d03c6e737ce5cb9c0f50436c619966ad41895ccf435fc3a532469143ca899c0d041fe0b06914c0583f62f6981c6b53b0e845386dd1c52fd10d1a4ce6df333ddeb399",
+	},
+	{
+		"aes-256-gcm",
+		"7d864f1d6a42f9bffd8a549c3bf9aff11ade7ec815cd9adf21b92c2679f4364c70936ff27a4e1b28c3996ce5e9ba42aace843bb30a7a890498868b619262c45afd",
+		"33ba962088e5cae3247d9109f5e2568af4d954bb3215d1e7a9be5ba1986fd6f4cf359b4388c91804b00b12830789a0fe02319aaf92804a221aba842ab30d8ad724ed06aa9e0ea154df7b733918b08e53c967b3fa28c92a6772fce78a24a2f318271734",
+	},
+	{
+		"chacha20-ietf-poly1305",
+		"8fde61fdcadf401879ae619527d861b60e481cd664fcfc36c0d25a46a5632ba25b36b9ace546a77e2c9bd67fb645cffac9c8bca1ffa52e8637c715c8d9d37429cb",
+		"eac5c88da47bf2437ca7bfd91420d4c087fd8412ac253c3e7aac2240e80b53e22ea4c7d22f733c1a630c07bca008605f3e2b01b6d6c380eb071bb29155317a2915aedd9ee09e7855bb4b043c72429edaf4d58a18dc5623bdb6a62152cdd73b8430e949",
+	},
+}
+
+func TestAEADPacketVectors(t *testing.T) {
+	want := append([]byte{socksAtypIPv4, 127, 0, 0, 1, 0, 53}, "hello, udp"...)
+	for _, v := range aeadVectors {
+		cipher, err := newCipher(v.method, aeadTestPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc := cipher.packetConn(nil, false)
+		pkt := unhex(t, v.udp)
+		if plain, err := pc.open(pkt); err != nil || !bytes.Equal(plain, want) {
+			t.Errorf("%s: open() = %q, %v", v.method, plain, err)
+		}
+		pkt[len(pkt)-1] ^= 1
+		if _, err := pc.open(pkt); err == nil {
+			t.Errorf("%s: a tampered packet opened", v.method)
+		}
+	}
+}
+
+func TestAEADStreamVectors(t *testing.T) {
+	want := append([]byte{socksAtypDomain, 11}, "example.org\x00\x50GET / HTTP/1.1\r\n\r\n"...)
+	for _, v := range aeadVectors {
+		cipher, err := newCipher(v.method, aeadTestPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &aeadConn{Conn: headerConn(t, unhex(t, v.tcp)), c: cipher.(*aeadCipher)}
+		if got, err := ioutil.ReadAll(conn); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: read %q, %v", v.method, got, err)
+		}
+	}
+}
+
+// sealStream returns what an aeadConn of cipher puts on the wire for b
+func sealStream(t *testing.T, cipher *aeadCipher, b []byte) []byte {
+	client, server := net.Pipe()
+	go func() {
+		(&aeadConn{Conn: client, c: cipher}).Write(b)
+		client.Close()
+	}()
+	raw, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestAEADChunkCap(t *testing.T) {
+	cipher, err := newCipher("aes-256-gcm", aeadTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := cipher.(*aeadCipher)
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*aeadMaxPayload+100)/16)
+	raw := sealStream(t, ac, data)
+	// two full chunks and the rest, each a sealed length and a sealed payload
+	if want := ac.saltSize() + 3*(2+2*aeadTagSize) + len(data); len(raw) != want {
+		t.Errorf("%d bytes on the wire, want %d", len(raw), want)
+	}
+	got, err := ioutil.ReadAll(&aeadConn{Conn: headerConn(t, raw), c: ac})
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, %v, want %d", len(got), err, len(data))
+	}
+}
+
+func TestAEADChunkTooLarge(t *testing.T) {
+	cipher, err := newCipher("aes-128-gcm", aeadTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := cipher.(*aeadCipher)
+	salt := make([]byte, ac.saltSize())
+	aead, err := ac.session(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := aeadMaxPayload + 1
+	raw := aead.Seal(salt, make([]byte, aead.NonceSize()), []byte{byte(size >> 8), byte(size)}, nil)
+	if _, err := ioutil.ReadAll(&aeadConn{Conn: headerConn(t, raw), c: ac}); err != errAEADPayload {
+		t.Errorf("read a %d byte chunk: %v", size, err)
+	}
+}
+
+func TestAEADPacketRoundTrip(t *testing.T) {
+	for _, v := range aeadVectors {
+		cipher, err := newCipher(v.method, aeadTestPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b := udpClient(t), udpClient(t)
+		b.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ca, cb := cipher.packetConn(a, false), cipher.packetConn(b, false)
+		// a datagram as large as the relay takes
+		data := bytes.Repeat([]byte{0xa5}, 60000)
+		if _, err := ca.WriteTo(data, b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MAX_UDPBUF)
+		n, addr, err := cb.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], data) || addr.String() != a.LocalAddr().String() {
+			t.Errorf("%s: ReadFrom() = %d bytes from %v, %v", v.method, n, addr, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// benchmark stream kinds, the first byte a bench stream sends
+const (
+	benchThroughput = 'T' // 8 bytes length, payload, then 1 byte ack from the server
+	benchEcho       = 'E' // everything is echoed back
+)
+
+const benchPingSize = 64
+
+// how long one bench case may take before its streams give up, a config
+// that can't get through loopback would otherwise hang the sweep
+const benchCaseTimeout = 2 * time.Minute
+
+// benchResult is one row of the comparison table
+type benchResult struct {
+	throughput float64 // bytes per second
+	p50        time.Duration
+	p99        time.Duration
+	cpuPerByte float64 // nanoseconds, both ends of the tunnel
+}
+
+func handleBenchStream(stream net.Conn) {
+	defer stream.Close()
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(stream, kind); err != nil {
+		return
+	}
+	switch kind[0] {
+	case benchThroughput:
+		var size uint64
+		if err := binary.Read(stream, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, stream, int64(size)); err != nil {
+			return
+		}
+		stream.Write(kind)
+	case benchEcho:
+		io.Copy(stream, stream)
+	}
+}
+
+// benchCase runs a kcp client and server over loopback with config, then
+// pushes size bytes through one stream and bounces pings small messages on
+// another one.
+func benchCase(config Config, size, pings int) (*benchResult, error) {
+	if err := applyMode(&config); err != nil {
+		return nil, err
+	}
+	block := newBlockCrypt(&config)
+	smuxConfig, err := newSmuxConfig(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	impair, err := parseNetem(config.Netem)
+	if err != nil {
+		return nil, err
+	}
+
+	// both ends go through the emulator, if any
+	listen := func() (net.PacketConn, error) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil || impair == nil {
+			return conn, err
+		}
+		return newNetemConn(conn, impair), nil
+	}
+
+	serverConn, err := listen()
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	defer serverConn.Close()
+	lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, serverConn)
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	defer lis.Close()
+	go serveKCP(lis, &config, smuxConfig, handleBenchStream)
+
+	clientConn, err := listen()
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	defer clientConn.Close()
+	kcpconn, err := kcp.NewConn(serverConn.LocalAddr().String(), block, config.DataShard, config.ParityShard, clientConn)
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	tuneKCP(kcpconn, &config)
+	session, err := smux.Client(compress(kcpconn, &config), smuxConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	defer session.Close()
+
+	result := &benchResult{}
+	deadline := time.Now().Add(benchCaseTimeout)
+
+	// throughput, random payload so compression gets no free ride
+	stream, err, _ := session.OpenStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	stream.SetDeadline(deadline)
+	buf := make([]byte, 32*1024)
+	rand.Read(buf)
+	header := make([]byte, 9)
+	header[0] = benchThroughput
+	binary.BigEndian.PutUint64(header[1:], uint64(size))
+	cpu, start := cpuTime(), time.Now()
+	if _, err := stream.Write(header); err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	for sent := 0; sent < size; {
+		n := len(buf)
+		if size-sent < n {
+			n = size - sent
+		}
+		if _, err := stream.Write(buf[:n]); err != nil {
+			return nil, errors.Wrap(err, "benchCase()")
+		}
+		sent += n
+	}
+	if _, err := io.ReadFull(stream, header[:1]); err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	elapsed := time.Since(start)
+	result.throughput = float64(size) / elapsed.Seconds()
+	result.cpuPerByte = float64(cpuTime()-cpu) / float64(size)
+	stream.Close()
+
+	// stream latency
+	stream, err, _ = session.OpenStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	defer stream.Close()
+	stream.SetDeadline(deadline)
+	if _, err := stream.Write([]byte{benchEcho}); err != nil {
+		return nil, errors.Wrap(err, "benchCase()")
+	}
+	rtts := make([]time.Duration, pings)
+	ping := buf[:benchPingSize]
+	pong := make([]byte, benchPingSize)
+	for i := range rtts {
+		start := time.Now()
+		if _, err := stream.Write(ping); err != nil {
+			return nil, errors.Wrap(err, "benchCase()")
+		}
+		if _, err := io.ReadFull(stream, pong); err != nil {
+			return nil, errors.Wrap(err, "benchCase()")
+		}
+		rtts[i] = time.Since(start)
+	}
+	if pings > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		result.p50 = rtts[pings/2]
+		result.p99 = rtts[pings*99/100]
+	}
+	return result, nil
+}
+
+// benchMatrix crosses the swept settings into configs based on base. Windows
+// and FEC are given as pairs like 256:2048 and 10:3.
+func benchMatrix(base Config, modes, crypts []string, mtus []int, wnds, fecs []string) ([]Config, []string, error) {
+	var configs []Config
+	var names []string
+	for _, mode := range modes {
+		for _, crypt := range crypts {
+			for _, mtu := range mtus {
+				for _, wnd := range wnds {
+					snd, rcv, err := parsePair(wnd)
+					if err != nil {
+						return nil, nil, err
+					}
+					for _, fec := range fecs {
+						ds, ps, err := parsePair(fec)
+						if err != nil {
+							return nil, nil, err
+						}
+						config := base
+						config.Mode, config.Crypt, config.MTU = mode, crypt, mtu
+						config.SndWnd, config.RcvWnd = snd, rcv
+						config.DataShard, config.ParityShard = ds, ps
+						configs = append(configs, config)
+						names = append(names, fmt.Sprintf("%s/%s/mtu%d/wnd%d:%d/fec%d:%d", mode, crypt, mtu, snd, rcv, ds, ps))
+					}
+				}
+			}
+		}
+	}
+	return configs, names, nil
+}
+
+func parsePair(s string) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("parsePair(): %q is not like a:b", s)
+	}
+	a, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "parsePair()")
+	}
+	b, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "parsePair()")
+	}
+	return a, b, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func printBenchTable(w io.Writer, names []string, results []*benchResult) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "config\tMB/s\tp50\tp99\tcpu ns/B\t")
+	for i, r := range results {
+		if r == nil {
+			fmt.Fprintf(tw, "%s\tfailed\t\t\t\t\n", names[i])
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%.2f\t%v\t%v\t%.2f\t\n", names[i], r.throughput/(1<<20),
+			r.p50.Round(time.Microsecond), r.p99.Round(time.Microsecond), r.cpuPerByte)
+	}
+	tw.Flush()
+}
+
+// Bench sweeps kcp settings over a loopback client/server pair and prints
+// throughput, stream latency and cpu cost for every combination.
+func Bench() {
+	myApp := cli.NewApp()
+	myApp.Name = "kcpbench"
+	myApp.Usage = "loopback benchmark of kcp settings"
+	myApp.Version = VERSION
+	myApp.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "mode",
+			Value: "normal,fast,fast2,fast3",
+			Usage: "comma separated modes to sweep",
+		},
+		cli.StringFlag{
+			Name:  "crypt",
+			Value: "none,aes,salsa20",
+			Usage: "comma separated ciphers to sweep",
+		},
+		cli.StringFlag{
+			Name:  "mtu",
+			Value: "1350",
+			Usage: "comma separated mtus to sweep",
+		},
+		cli.StringFlag{
+			Name:  "wnd",
+			Value: "256:2048",
+			Usage: "comma separated sndwnd:rcvwnd pairs to sweep",
+		},
+		cli.StringFlag{
+			Name:  "fec",
+			Value: "0:0,10:3",
+			Usage: "comma separated datashard:parityshard pairs to sweep",
+		},
+		cli.BoolFlag{
+			Name:  "nocomp",
+			Usage: "disable compression",
+		},
+		cli.StringFlag{
+			Name:  "netem",
+			Value: "",
+			Usage: "impair both ends of the loopback link, like: loss=10%,latency=50ms",
+		},
+		cli.IntFlag{
+			Name:  "size",
+			Value: 16 << 20,
+			Usage: "bytes to push through the throughput stream",
+		},
+		cli.IntFlag{
+			Name:  "pings",
+			Value: 1000,
+			Usage: "round trips to measure stream latency with",
+		},
+	}
+	myApp.Action = func(c *cli.Context) error {
+		base := Config{
+			Key:                  "bench",
+			NoComp:               c.Bool("nocomp"),
+			Netem:                c.String("netem"),
+			SockBuf:              4194304,
+			KeepAlive:            10,
+			FrameSize:            32768,
+			SmuxKeepAlive:        10,
+			SmuxKeepAliveTimeout: 30,
+		}
+		var mtus []int
+		for _, v := range splitList(c.String("mtu")) {
+			mtu, err := strconv.Atoi(v)
+			if err != nil {
+				return errors.Wrap(err, "mtu")
+			}
+			mtus = append(mtus, mtu)
+		}
+		configs, names, err := benchMatrix(base, splitList(c.String("mode")), splitList(c.String("crypt")),
+			mtus, splitList(c.String("wnd")), splitList(c.String("fec")))
+		if err != nil {
+			return err
+		}
+
+		results := make([]*benchResult, len(configs))
+		for i := range configs {
+			log.Println("bench:", names[i])
+			if results[i], err = benchCase(configs[i], c.Int("size"), c.Int("pings")); err != nil {
+				log.Println("bench:", names[i], err)
+			}
+		}
+		printBenchTable(os.Stdout, names, results)
+		return nil
+	}
+	myApp.Run(os.Args)
+}
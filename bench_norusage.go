@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package kcp
+
+import "time"
+
+// cpuTime is not available on this platform, cpu per byte reads as zero
+func cpuTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,127 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func benchTestConfig(mode string) Config {
+	return Config{
+		Key:                  "bench",
+		Crypt:                "aes",
+		Mode:                 mode,
+		MTU:                  1350,
+		SndWnd:               1024,
+		RcvWnd:               1024,
+		SockBuf:              4194304,
+		FrameSize:            32768,
+		SmuxKeepAlive:        10,
+		SmuxKeepAliveTimeout: 30,
+	}
+}
+
+// go test -run none -bench KCP
+func BenchmarkKCPThroughput(b *testing.B) {
+	const chunk = 32 * 1024
+	for _, mode := range []string{"normal", "fast3"} {
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(chunk)
+			result, err := benchCase(benchTestConfig(mode), b.N*chunk, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(result.cpuPerByte, "cpu-ns/B")
+		})
+	}
+}
+
+func BenchmarkKCPLatency(b *testing.B) {
+	for _, mode := range []string{"normal", "fast3"} {
+		b.Run(mode, func(b *testing.B) {
+			result, err := benchCase(benchTestConfig(mode), 1, b.N)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(result.p99)/float64(time.Microsecond), "p99-µs")
+		})
+	}
+}
+
+func TestHandleBenchStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleBenchStream(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	header := make([]byte, 9)
+	header[0] = benchThroughput
+	binary.BigEndian.PutUint64(header[1:], 1000)
+	client.Write(header)
+	client.Write(make([]byte, 1000))
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(client, ack); err != nil || ack[0] != benchThroughput {
+		t.Fatalf("ack = %v, %v", ack, err)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go handleBenchStream(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte{benchEcho})
+	go client.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(client, pong); err != nil || string(pong) != "ping" {
+		t.Errorf("echo = %q, %v", pong, err)
+	}
+}
+
+func TestBenchMatrix(t *testing.T) {
+	configs, names, err := benchMatrix(Config{Key: "k"}, []string{"fast", "normal"}, []string{"none"},
+		[]int{1350}, []string{"256:2048"}, []string{"0:0", "10:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 4 || len(names) != 4 {
+		t.Fatalf("benchMatrix() = %d configs", len(configs))
+	}
+	if c := configs[1]; c.Mode != "fast" || c.DataShard != 10 || c.ParityShard != 3 || c.SndWnd != 256 || c.RcvWnd != 2048 || c.Key != "k" {
+		t.Errorf("configs[1] = %+v", c)
+	}
+	if names[1] != "fast/none/mtu1350/wnd256:2048/fec10:3" {
+		t.Errorf("names[1] = %q", names[1])
+	}
+	if _, _, err := benchMatrix(Config{}, []string{"fast"}, []string{"none"}, []int{1350}, []string{"256"}, []string{"0:0"}); err == nil {
+		t.Error("benchMatrix() accepted a window without a pair")
+	}
+}
+
+func TestParsePair(t *testing.T) {
+	if a, b, err := parsePair("10:3"); a != 10 || b != 3 || err != nil {
+		t.Errorf("parsePair() = %d, %d, %v", a, b, err)
+	}
+	for _, s := range []string{"10", "a:3", "10:b", ""} {
+		if _, _, err := parsePair(s); err == nil {
+			t.Errorf("parsePair(%q): no error", s)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	if got := splitList(" fast, ,normal ,"); len(got) != 2 || got[0] != "fast" || got[1] != "normal" {
+		t.Errorf("splitList() = %q", got)
+	}
+}
+
+func TestPrintBenchTable(t *testing.T) {
+	var buf bytes.Buffer
+	printBenchTable(&buf, []string{"good", "bad"}, []*benchResult{{throughput: 1 << 20}, nil})
+	out := buf.String()
+	if !strings.Contains(out, "1.00") || !strings.Contains(out, "failed") {
+		t.Errorf("printBenchTable() = %q", out)
+	}
+}
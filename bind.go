@@ -0,0 +1,168 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// boundSession is a kcp session over a socket from listenPacket, the socket
+// is closed together with the session
+type boundSession struct {
+	*kcp.UDPSession
+	conn *net.UDPConn
+}
+
+func (s *boundSession) Close() error {
+	err := s.UDPSession.Close()
+	s.conn.Close()
+	return err
+}
+
+// socketControl is the hook applied to a socket before bind(2)
+type socketControl func(network, address string, c syscall.RawConn) error
+
+// bindOptions turns a bind spec, either a local interface name or a source
+// address, into the local address and socket hook for network
+func bindOptions(network, bind string) (laddr string, control socketControl, err error) {
+	if bind == "" {
+		return "", nil, nil
+	}
+	if ip := net.ParseIP(bind); ip != nil {
+		if (ip.To4() != nil) != (network == "udp4") {
+			return "", nil, errors.Errorf("bind %s: address family does not match %s", bind, network)
+		}
+		return net.JoinHostPort(ip.String(), "0"), nil, nil
+	}
+	return bindDevice(network, bind)
+}
+
+// interfaceAddr returns the first address of the interface in the family of network
+func interfaceAddr(network, name string) (string, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", errors.Wrap(err, "interfaceAddr()")
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", errors.Wrap(err, "interfaceAddr()")
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && (ipnet.IP.To4() != nil) == (network == "udp4") {
+			return net.JoinHostPort(ipnet.IP.String(), "0"), nil
+		}
+	}
+	return "", errors.Errorf("interfaceAddr(): no %s address on %s", network, name)
+}
+
+// udpNetwork returns the family specific network for raddr, a socket bound to
+// an interface or source address can only talk to one family
+func udpNetwork(raddr string) (string, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return "", err
+	}
+	if udpaddr.IP.To4() != nil {
+		return "udp4", nil
+	}
+	return "udp6", nil
+}
+
+// listenPacket opens the UDP socket of a kcp session, bound as told by bind
+func listenPacket(raddr, bind string) (*net.UDPConn, error) {
+	network, err := udpNetwork(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listenPacket()")
+	}
+	laddr, control, err := bindOptions(network, bind)
+	if err != nil {
+		return nil, errors.Wrap(err, "listenPacket()")
+	}
+	lc := net.ListenConfig{Control: control}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listenPacket()")
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// checkRoute fails fast when a socket bound as told by bind has no route to
+// raddr, which is the common failure of an ipv6 candidate on a v4-only
+// network or of an interface that is down
+func checkRoute(raddr, bind string) error {
+	network, err := udpNetwork(raddr)
+	if err != nil {
+		return err
+	}
+	laddr, control, err := bindOptions(network, bind)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Control: control}
+	if laddr != "" {
+		if dialer.LocalAddr, err = net.ResolveUDPAddr(network, laddr); err != nil {
+			return err
+		}
+	}
+	conn, err := dialer.Dial(network, raddr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// linkHealthy reports whether a session bound as told by bind can carry
+// streams: the interface is up and the server was heard from within silence.
+// A nil probe, a stream transport, only has the interface to go by.
+func linkHealthy(bind string, probe *linkProbe, silence time.Duration) bool {
+	if !interfaceUp(bind) {
+		return false
+	}
+	return probe == nil || probe.silence() < silence
+}
+
+// interfaceUp reports whether the interface named by bind, or the one holding
+// the source address bind, is up
+func interfaceUp(bind string) bool {
+	if bind == "" {
+		return true
+	}
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		ifi, err := net.InterfaceByName(bind)
+		return err == nil && ifi.Flags&net.FlagUp != 0
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// socketFd returns the file descriptor of conn, a socket or a listener, -1
+// if unavailable
+func socketFd(conn syscall.Conn) int {
+	fd := -1
+	if rc, err := conn.SyscallConn(); err == nil {
+		rc.Control(func(s uintptr) { fd = int(s) })
+	}
+	return fd
+}
@@ -0,0 +1,18 @@
+package kcp
+
+import "syscall"
+
+// bindDevice pins the socket to the interface with SO_BINDTODEVICE, so it
+// keeps using that link whatever the routing table says
+func bindDevice(network, device string) (string, socketControl, error) {
+	control := func(network, address string, c syscall.RawConn) error {
+		var operr error
+		if err := c.Control(func(fd uintptr) {
+			operr = syscall.BindToDevice(int(fd), device)
+		}); err != nil {
+			return err
+		}
+		return operr
+	}
+	return "", control, nil
+}
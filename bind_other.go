@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package kcp
+
+// bindDevice binds to the current address of the interface, which is the
+// closest we get to SO_BINDTODEVICE off linux
+func bindDevice(network, device string) (string, socketControl, error) {
+	laddr, err := interfaceAddr(network, device)
+	return laddr, nil, err
+}
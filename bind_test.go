@@ -0,0 +1,121 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// loopbackName is the name of the loopback interface, lo or lo0
+func loopbackName(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestBindOptionsAddress(t *testing.T) {
+	laddr, control, err := bindOptions("udp4", "127.0.0.1")
+	if err != nil || laddr != "127.0.0.1:0" || control != nil {
+		t.Errorf("bindOptions() = %q, %v", laddr, err)
+	}
+	if _, _, err := bindOptions("udp6", "127.0.0.1"); err == nil {
+		t.Error("bindOptions() bound an ipv4 address for udp6")
+	}
+	if laddr, control, err := bindOptions("udp4", ""); laddr != "" || control != nil || err != nil {
+		t.Error("bindOptions() bound without a bind spec")
+	}
+}
+
+func TestListenPacketBound(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	raddr := server.LocalAddr().String()
+	if err := checkRoute(raddr, "127.0.0.1"); err != nil {
+		t.Fatalf("checkRoute(): %v", err)
+	}
+	conn, err := listenPacket(raddr, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("listenPacket() bound to %v", ip)
+	}
+	if socketFd(conn) < 0 {
+		t.Error("socketFd() = -1")
+	}
+}
+
+func TestSocketFdListener(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if socketFd(ln) < 0 {
+		t.Error("socketFd() of a listener = -1")
+	}
+}
+
+func TestInterfaceUp(t *testing.T) {
+	lo := loopbackName(t)
+	for bind, want := range map[string]bool{
+		"":            true,
+		lo:            true,
+		"127.0.0.1":   true,
+		"nosuchif0":   false,
+		"192.0.2.123": false, // TEST-NET-1, on no interface
+	} {
+		if got := interfaceUp(bind); got != want {
+			t.Errorf("interfaceUp(%q) = %v, want %v", bind, got, want)
+		}
+	}
+}
+
+func TestLinkHealthy(t *testing.T) {
+	server := echoServer(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	probe := newLinkProbe(conn)
+	if linkHealthy("127.0.0.1", probe, time.Second) {
+		t.Error("a link the server never answered on is healthy")
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := probe.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	probe.WriteTo([]byte("ping"), server.LocalAddr())
+	if err := probe.wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !linkHealthy("127.0.0.1", probe, time.Second) {
+		t.Error("an answered link is unhealthy")
+	}
+	if linkHealthy("127.0.0.1", probe, time.Nanosecond) {
+		t.Error("a link silent for longer than allowed is healthy")
+	}
+	if linkHealthy("nosuchif0", probe, time.Second) {
+		t.Error("a link on a missing interface is healthy")
+	}
+	if !linkHealthy("", nil, time.Second) {
+		t.Error("an unbound stream transport is unhealthy")
+	}
+}
@@ -3,32 +3,96 @@ package kcp
 import (
 	"encoding/json"
 	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
 )
 
 // Config for client
 type Config struct {
-	LocalAddr    string `json:"localaddr"`
-	RemoteAddr   string `json:"remoteaddr"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	Conn         int    `json:"conn"`
-	AutoExpire   int    `json:"autoexpire"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
+	LocalAddr            string             `json:"localaddr"`
+	RemoteAddr           string             `json:"remoteaddr"`
+	Key                  string             `json:"key"`
+	Keys                 []string           `json:"keys"`
+	Crypt                string             `json:"crypt"`
+	Mode                 string             `json:"mode"`
+	Profiles             map[string]Profile `json:"profiles"`
+	Conn                 int                `json:"conn"`
+	Bind                 []string           `json:"bind"`
+	AutoExpire           int                `json:"autoexpire"`
+	MTU                  int                `json:"mtu"`
+	SndWnd               int                `json:"sndwnd"`
+	RcvWnd               int                `json:"rcvwnd"`
+	DataShard            int                `json:"datashard"`
+	ParityShard          int                `json:"parityshard"`
+	DSCP                 int                `json:"dscp"`
+	NoComp               bool               `json:"nocomp"`
+	AckNodelay           bool               `json:"acknodelay"`
+	NoDelay              int                `json:"nodelay"`
+	Interval             int                `json:"interval"`
+	Resend               int                `json:"resend"`
+	NoCongestion         int                `json:"nc"`
+	SockBuf              int                `json:"sockbuf"`
+	KeepAlive            int                `json:"keepalive"`
+	FrameSize            int                `json:"framesize"`
+	SmuxKeepAlive        int                `json:"smuxkeepalive"`
+	SmuxKeepAliveTimeout int                `json:"smuxkeepalivetimeout"`
+	HopInterval          int                `json:"hopinterval"`
+	Family               string             `json:"family"`
+	Log                  string             `json:"log"`
+	SnmpLog              string             `json:"snmplog"`
+	SnmpPeriod           int                `json:"snmpperiod"`
+	Metrics              string             `json:"metrics"`
+	Netem                string             `json:"netem"`
+	Fallback             string             `json:"fallback"`
+	FallbackAfter        int                `json:"fallbackafter"`
+	FallbackRetry        int                `json:"fallbackretry"`
+	FallbackAddr         string             `json:"fallbackaddr"`
+	TLSServerName        string             `json:"tlsservername"`
+	TLSInsecure          bool               `json:"tlsinsecure"`
+	TLSCA                string             `json:"tlsca"`
+	Transport            string             `json:"transport"`
+	WSPath               string             `json:"wspath"`
+	WSHost               string             `json:"wshost"`
+	HTTPProxy            string             `json:"httpproxy"`
+	Mappings             []Mapping          `json:"mappings"`
+	SocketMode           string             `json:"socketmode"`
+	SocketOwner          string             `json:"socketowner"`
+	Allow                []string           `json:"allow"`
+	Deny                 []string           `json:"deny"`
+	ProxyProtocol        int                `json:"proxyprotocol"`
+}
+
+// Profile is a named preset of kcp parameters, the fields left out keep
+// their configured values
+type Profile struct {
+	NoDelay      *int `json:"nodelay"`
+	Interval     *int `json:"interval"`
+	Resend       *int `json:"resend"`
+	NoCongestion *int `json:"nc"`
+	SndWnd       *int `json:"sndwnd"`
+	RcvWnd       *int `json:"rcvwnd"`
+	MTU          *int `json:"mtu"`
+	DataShard    *int `json:"datashard"`
+	ParityShard  *int `json:"parityshard"`
+}
+
+func (p *Profile) apply(config *Config) {
+	set := func(dst *int, v *int) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&config.NoDelay, p.NoDelay)
+	set(&config.Interval, p.Interval)
+	set(&config.Resend, p.Resend)
+	set(&config.NoCongestion, p.NoCongestion)
+	set(&config.SndWnd, p.SndWnd)
+	set(&config.RcvWnd, p.RcvWnd)
+	set(&config.MTU, p.MTU)
+	set(&config.DataShard, p.DataShard)
+	set(&config.ParityShard, p.ParityShard)
 }
 
 func parseJSONConfig(config *Config, path string) error {
@@ -40,3 +104,45 @@ func parseJSONConfig(config *Config, path string) error {
 
 	return json.NewDecoder(file).Decode(config)
 }
+
+// mergeKeys puts the key first in the key rotation list, the oldkey flags
+// fill the list when the json file and uri gave none. It runs after both,
+// either may replace the key.
+func mergeKeys(config *Config, oldkeys []string) {
+	if len(config.Keys) == 0 {
+		if len(oldkeys) == 0 {
+			return
+		}
+		config.Keys = oldkeys
+	}
+	keys := []string{config.Key}
+	for _, key := range config.Keys {
+		if key != config.Key {
+			keys = append(keys, key)
+		}
+	}
+	config.Keys = keys
+}
+
+// newSmuxConfig builds and validates the stream multiplexer settings
+func newSmuxConfig(config *Config) (*smux.Config, error) {
+	if config.SmuxKeepAlive <= 0 {
+		return nil, errors.New("smuxkeepalive must be positive")
+	}
+	if config.SmuxKeepAliveTimeout < config.SmuxKeepAlive {
+		return nil, errors.New("smuxkeepalivetimeout must not be less than smuxkeepalive")
+	}
+	if config.FrameSize <= 0 || config.FrameSize > 65535 {
+		return nil, errors.New("framesize must be in range (0, 65535]")
+	}
+
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.MaxReceiveBuffer = config.SockBuf
+	smuxConfig.MaxFrameSize = config.FrameSize
+	smuxConfig.KeepAliveInterval = time.Duration(config.SmuxKeepAlive) * time.Second
+	smuxConfig.KeepAliveTimeout = time.Duration(config.SmuxKeepAliveTimeout) * time.Second
+	if err := smux.VerifyConfig(smuxConfig); err != nil {
+		return nil, err
+	}
+	return smuxConfig, nil
+}
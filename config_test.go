@@ -0,0 +1,82 @@
+package kcp
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func smuxTestConfig() *Config {
+	return &Config{
+		SockBuf:              4194304,
+		FrameSize:            32768,
+		SmuxKeepAlive:        10,
+		SmuxKeepAliveTimeout: 30,
+	}
+}
+
+func TestNewSmuxConfig(t *testing.T) {
+	smuxConfig, err := newSmuxConfig(smuxTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smuxConfig.MaxReceiveBuffer != 4194304 || smuxConfig.MaxFrameSize != 32768 ||
+		smuxConfig.KeepAliveInterval != 10*time.Second || smuxConfig.KeepAliveTimeout != 30*time.Second {
+		t.Errorf("newSmuxConfig() = %+v", *smuxConfig)
+	}
+}
+
+func TestNewSmuxConfigInvalid(t *testing.T) {
+	for name, change := range map[string]func(c *Config){
+		"keepalive":      func(c *Config) { c.SmuxKeepAlive = 0 },
+		"timeout":        func(c *Config) { c.SmuxKeepAliveTimeout = 5 },
+		"framesize":      func(c *Config) { c.FrameSize = 65536 },
+		"zero framesize": func(c *Config) { c.FrameSize = 0 },
+	} {
+		config := smuxTestConfig()
+		change(config)
+		if _, err := newSmuxConfig(config); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestApplyModeBuiltin(t *testing.T) {
+	config := Config{Mode: "fast3", NoDelay: 0, Interval: 40, SndWnd: 128}
+	if err := applyMode(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config.NoDelay != 1 || config.Interval != 30 || config.Resend != 1 || config.NoCongestion != 1 || config.SndWnd != 128 {
+		t.Errorf("applyMode(fast3) = %+v", config)
+	}
+	for _, mode := range []string{"", "manual"} {
+		config := Config{Mode: mode, Interval: 40}
+		if err := applyMode(&config); err != nil || config.Interval != 40 {
+			t.Errorf("applyMode(%q) changed the raw values", mode)
+		}
+	}
+	if err := applyMode(&Config{Mode: "fast4"}); err == nil {
+		t.Error("applyMode() accepted an unknown mode")
+	}
+}
+
+func TestApplyModeProfile(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{
+		"mode": "fast",
+		"interval": 40,
+		"mtu": 1350,
+		"profiles": {"fast": {"interval": 20, "sndwnd": 1024, "parityshard": 0}}
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ParityShard = 3
+	if err := applyMode(&config); err != nil {
+		t.Fatal(err)
+	}
+	// the user profile wins over the built-in fast, what it leaves out stays
+	if config.Interval != 20 || config.SndWnd != 1024 || config.ParityShard != 0 || config.MTU != 1350 || config.NoDelay != 0 {
+		t.Errorf("applyMode() = %+v", config)
+	}
+}
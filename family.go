@@ -0,0 +1,147 @@
+package kcp
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// address family preferences for resolving the kcp server
+const (
+	familyAuto    = "auto"    // interleave ipv6 and ipv4, ipv6 first (RFC 8305)
+	familyPrefer4 = "prefer4" // all ipv4 candidates before ipv6
+	familyPrefer6 = "prefer6" // all ipv6 candidates before ipv4
+	familyIPv4    = "ipv4"    // ipv4 only
+	familyIPv6    = "ipv6"    // ipv6 only
+)
+
+// delay before the next candidate joins the race
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// splitHostPort is net.SplitHostPort with a readable error for ipv6 literals
+// given without brackets
+func splitHostPort(addr string) (host, port string, err error) {
+	host, port, err = net.SplitHostPort(addr)
+	if err != nil && strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+		return "", "", errors.Errorf("address %s: ipv6 literal must be enclosed in brackets, e.g. [::1]:12948", addr)
+	}
+	return host, port, err
+}
+
+func checkFamily(family string) error {
+	switch family {
+	case familyAuto, familyPrefer4, familyPrefer6, familyIPv4, familyIPv6:
+		return nil
+	}
+	return errors.Errorf("unknown address family %q", family)
+}
+
+// resolveHost looks up host and orders the addresses by family preference
+func resolveHost(host, family string) ([]net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolveHost()")
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var ordered []net.IP
+	switch family {
+	case familyIPv4:
+		ordered = v4
+	case familyIPv6:
+		ordered = v6
+	case familyPrefer4:
+		ordered = append(v4, v6...)
+	case familyPrefer6:
+		ordered = append(v6, v4...)
+	default:
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v6) {
+				ordered = append(ordered, v6[i])
+			}
+			if i < len(v4) {
+				ordered = append(ordered, v4[i])
+			}
+		}
+	}
+	if len(ordered) == 0 {
+		return nil, errors.Errorf("resolveHost(): no %s address for %s", family, host)
+	}
+	return ordered, nil
+}
+
+// raceDial dials the candidates Happy Eyeballs style: the next candidate
+// starts after happyEyeballsDelay or as soon as the previous one fails. dial
+// returns once the server has answered, so the first path with a round trip
+// wins and the late ones are closed.
+func raceDial(addrs []string, dial func(raddr string) (*probedSession, error)) (*probedSession, error) {
+	type result struct {
+		session *probedSession
+		err     error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		raddr := addrs[next]
+		next++
+		pending++
+		go func() {
+			session, err := dial(raddr)
+			results <- result{session, err}
+		}()
+	}
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(happyEyeballsDelay)
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.err == nil {
+							r.session.Close()
+						}
+					}
+				}(pending)
+				return r.session, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				restart()
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,114 @@
+package kcp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	host, port, err := splitHostPort("[2001:db8::1]:29900")
+	if err != nil || host != "2001:db8::1" || port != "29900" {
+		t.Errorf("splitHostPort() = %q, %q, %v", host, port, err)
+	}
+	if _, _, err := splitHostPort("2001:db8::1:29900"); err == nil {
+		t.Error("splitHostPort() accepted an ipv6 literal without brackets")
+	}
+}
+
+func TestCheckFamily(t *testing.T) {
+	for _, family := range []string{familyAuto, familyPrefer4, familyPrefer6, familyIPv4, familyIPv6} {
+		if err := checkFamily(family); err != nil {
+			t.Errorf("checkFamily(%q): %v", family, err)
+		}
+	}
+	if err := checkFamily("ipv5"); err == nil {
+		t.Error("checkFamily(ipv5): no error")
+	}
+}
+
+func TestResolveHostLiteral(t *testing.T) {
+	ips, err := resolveHost("127.0.0.1", familyAuto)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("resolveHost() = %v, %v", ips, err)
+	}
+	if _, err := resolveHost("127.0.0.1", familyIPv6); err == nil {
+		t.Error("resolveHost() returned an ipv4 address for ipv6")
+	}
+}
+
+// testSession is a smux session over one end of a pipe
+func testSession(t *testing.T) *probedSession {
+	a, b := net.Pipe()
+	t.Cleanup(func() { b.Close() })
+	session, err := smux.Client(a, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &probedSession{session: session}
+}
+
+func TestRaceDialFirstAnswerWins(t *testing.T) {
+	slow, fast := testSession(t), testSession(t)
+	var lock sync.Mutex
+	var started []string
+	dial := func(raddr string) (*probedSession, error) {
+		lock.Lock()
+		started = append(started, raddr)
+		lock.Unlock()
+		if raddr == "slow" {
+			// a path that only answers after the others started
+			time.Sleep(3 * happyEyeballsDelay)
+			return slow, nil
+		}
+		return fast, nil
+	}
+	got, err := raceDial([]string{"slow", "fast"}, dial)
+	if err != nil || got != fast {
+		t.Fatalf("raceDial() = %v, %v, want the fast session", got, err)
+	}
+	deadline := time.Now().Add(time.Second + 3*happyEyeballsDelay)
+	for !slow.session.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the late session was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fast.session.IsClosed() {
+		t.Error("the winning session was closed")
+	}
+}
+
+func TestRaceDialFailureStartsNext(t *testing.T) {
+	want := testSession(t)
+	start := time.Now()
+	got, err := raceDial([]string{"down", "up"}, func(raddr string) (*probedSession, error) {
+		if raddr == "down" {
+			return nil, errNoReply
+		}
+		return want, nil
+	})
+	if err != nil || got != want {
+		t.Fatalf("raceDial() = %v, %v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed >= happyEyeballsDelay {
+		t.Errorf("the next candidate waited %v after a failure", elapsed)
+	}
+}
+
+func TestRaceDialAllFail(t *testing.T) {
+	errDown := errors.New("down")
+	_, err := raceDial([]string{"a", "b", "c"}, func(raddr string) (*probedSession, error) {
+		if raddr == "a" {
+			return nil, errDown
+		}
+		return nil, errNoReply
+	})
+	if err != errDown {
+		t.Errorf("raceDial() = %v, want the first error", err)
+	}
+}
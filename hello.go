@@ -12,10 +12,11 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	//	"strconv"
 	"zerolib/udp/udplotus"
 
 	"github.com/gamexg/proxyclient"
@@ -316,7 +317,20 @@ func TestRequest2() {
 }
 
 func StartHttpProxy() {
-	l, err := net.Listen("tcp", "127.0.0.1:1081")
+	StartHttpProxyAt("127.0.0.1:1081", "", "", "", "", "", false)
+}
+
+// StartHttpProxyAt runs the http proxy on addr, which may be unix:/path with
+// the socket file mode (octal) and user[:group] owner. Clients are checked
+// against the comma separated allow and deny CIDRs. With acceptProxy every
+// connection must start with a PROXY protocol header from a load balancer,
+// one of the proxies CIDRs if given.
+func StartHttpProxyAt(addr, mode, owner, allow, deny, proxies string, acceptProxy bool) {
+	filter, err := newAddrFilter(strings.Split(allow, ","), strings.Split(deny, ","), strings.Split(proxies, ","))
+	if err != nil {
+		log.Panic(err)
+	}
+	l, err := listenLocal(addr, mode, owner)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -325,7 +339,7 @@ func StartHttpProxy() {
 		if err != nil {
 			log.Panic(err)
 		}
-		go handleClientRequest(client)
+		filter.serveAccepted(client, "http", acceptProxy, handleClientRequest)
 	}
 }
 
@@ -341,10 +355,10 @@ func handleClientRequest(client net.Conn) {
 		return
 	}
 	method, address := getAddress(b)
-	p, err := proxyclient.NewProxyClient("socks5://@127.0.0.1:1080")
+	httpProxyRequests.inc(labels("component", "http", "method", method))
 	log.Println("address:", address)
 	//获得了请求的host和port，就开始拨号吧
-	server, err := p.Dial("tcp", address)
+	server, err := dialSocks(address)
 	if err != nil {
 		log.Println(err)
 		return
@@ -359,6 +373,130 @@ func handleClientRequest(client net.Conn) {
 	io.Copy(client, server)
 }
 
+var (
+	socksUpstreamLock sync.Mutex
+	socksUpstream     = "127.0.0.1:1080"
+)
+
+// setSocksUpstream chains the http proxy to the socks5 listener on
+// listenAddr, host:port or unix:/path, a wildcard host is reached on loopback
+func setSocksUpstream(listenAddr string) {
+	if !isUnixAddr(listenAddr) {
+		if host, port, err := net.SplitHostPort(listenAddr); err == nil {
+			if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+				listenAddr = net.JoinHostPort("127.0.0.1", port)
+			}
+		}
+	}
+	socksUpstreamLock.Lock()
+	socksUpstream = listenAddr
+	socksUpstreamLock.Unlock()
+}
+
+// dialSocks connects to address, a host:port, with a socks5 CONNECT through
+// the socks upstream
+func dialSocks(address string) (net.Conn, error) {
+	socksUpstreamLock.Lock()
+	upstream := socksUpstream
+	socksUpstreamLock.Unlock()
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || len(host) > 255 {
+		return nil, fmt.Errorf("dialSocks: bad address %q", address)
+	}
+
+	network := "tcp"
+	if isUnixAddr(upstream) {
+		network, upstream = "unix", strings.TrimPrefix(upstream, unixPrefix)
+	}
+	conn, err := net.DialTimeout(network, upstream, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	// the listener answers each step before it reads the next, with socks
+	// users it wants one of them, RFC 1929
+	method := byte(socksMethodNone)
+	var auth []byte
+	if user, passwd, ok := socksCredential(); ok {
+		if len(user) > 255 || len(passwd) > 255 {
+			conn.Close()
+			return nil, fmt.Errorf("dialSocks: socks user %q too long", user)
+		}
+		method = socksMethodPassword
+		auth = append([]byte{socksAuthVer, byte(len(user))}, user...)
+		auth = append(auth, byte(len(passwd)))
+		auth = append(auth, passwd...)
+	}
+	reply := make([]byte, 255+2)
+	if _, err := conn.Write([]byte{socksVer5, 1, method}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[1] != method {
+		conn.Close()
+		return nil, fmt.Errorf("dialSocks: %s refused method %d", upstream, method)
+	}
+	if auth != nil {
+		if _, err := conn.Write(auth); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply[:2]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if reply[1] != socksAuthSuccess {
+			conn.Close()
+			return nil, fmt.Errorf("dialSocks: %s: authentication failed", upstream)
+		}
+	}
+	req := []byte{socksVer5, socksCmdConnect, 0, socksAtypDomain, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, reply[:4]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[1] != socksRepSucceeded {
+		conn.Close()
+		return nil, fmt.Errorf("dialSocks: %s: reply %d", address, reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len + 2
+	case socksAtypIPv6:
+		skip = net.IPv6len + 2
+	case socksAtypDomain:
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		skip = int(reply[0]) + 2
+	default:
+		conn.Close()
+		return nil, errAddrType
+	}
+	if _, err := io.ReadFull(conn, reply[:skip]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
 func getAddress(b [1024]byte) (method string, address string) {
 	var host string
 	log.Println("head:", string(b[:bytes.IndexByte(b[:], '\n')]))
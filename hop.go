@@ -0,0 +1,71 @@
+package kcp
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// remoteEndpoint is a kcp server address whose port may be a range,
+// e.g. "1.2.3.4:20000-20100"
+type remoteEndpoint struct {
+	host    string
+	minPort int
+	maxPort int
+}
+
+func parseRemoteAddr(addr string) (*remoteEndpoint, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "parseRemoteAddr()")
+	}
+
+	r := &remoteEndpoint{host: host}
+	if idx := strings.IndexByte(port, '-'); idx >= 0 {
+		if r.minPort, err = parsePort(port[:idx]); err != nil {
+			return nil, err
+		}
+		if r.maxPort, err = parsePort(port[idx+1:]); err != nil {
+			return nil, err
+		}
+		if r.minPort > r.maxPort {
+			return nil, errors.Errorf("parseRemoteAddr(): invalid port range %s", port)
+		}
+	} else {
+		if r.minPort, err = parsePort(port); err != nil {
+			return nil, err
+		}
+		r.maxPort = r.minPort
+	}
+	return r, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.Errorf("parsePort(): invalid port %q", s)
+	}
+	return port, nil
+}
+
+// hopping reports whether the endpoint spans more than one port
+func (r *remoteEndpoint) hopping() bool {
+	return r.maxPort > r.minPort
+}
+
+// pickPort returns a random port within the range other than current, so
+// that a hop always moves
+func (r *remoteEndpoint) pickPort(current string) string {
+	n := r.maxPort - r.minPort + 1
+	cur, err := strconv.Atoi(current)
+	if err != nil || n == 1 || cur < r.minPort || cur > r.maxPort {
+		return strconv.Itoa(r.minPort + rand.Intn(n))
+	}
+	port := r.minPort + rand.Intn(n-1)
+	if port >= cur {
+		port++
+	}
+	return strconv.Itoa(port)
+}
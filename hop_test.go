@@ -0,0 +1,76 @@
+package kcp
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseRemoteAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		host     string
+		min, max int
+		hopping  bool
+	}{
+		{"1.2.3.4:29900", "1.2.3.4", 29900, 29900, false},
+		{"example.com:20000-20100", "example.com", 20000, 20100, true},
+		{"[2001:db8::1]:1-2", "2001:db8::1", 1, 2, true},
+	}
+	for _, tt := range tests {
+		r, err := parseRemoteAddr(tt.addr)
+		if err != nil {
+			t.Fatalf("parseRemoteAddr(%q): %v", tt.addr, err)
+		}
+		if r.host != tt.host || r.minPort != tt.min || r.maxPort != tt.max || r.hopping() != tt.hopping {
+			t.Errorf("parseRemoteAddr(%q) = %+v", tt.addr, *r)
+		}
+	}
+}
+
+func TestParseRemoteAddrInvalid(t *testing.T) {
+	for _, addr := range []string{
+		"1.2.3.4",
+		"1.2.3.4:0",
+		"1.2.3.4:65536",
+		"1.2.3.4:200-100",
+		"1.2.3.4:a-b",
+		"2001:db8::1:80",
+	} {
+		if _, err := parseRemoteAddr(addr); err == nil {
+			t.Errorf("parseRemoteAddr(%q): no error", addr)
+		}
+	}
+}
+
+func TestPickPort(t *testing.T) {
+	r := &remoteEndpoint{host: "h", minPort: 20000, maxPort: 20003}
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		port, err := strconv.Atoi(r.pickPort(""))
+		if err != nil || port < r.minPort || port > r.maxPort {
+			t.Fatalf("pickPort() = %d, %v", port, err)
+		}
+		seen[port] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("pickPort() hit %d of 4 ports", len(seen))
+	}
+}
+
+func TestPickPortMoves(t *testing.T) {
+	r := &remoteEndpoint{host: "h", minPort: 20000, maxPort: 20003}
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		port := r.pickPort("20002")
+		if port == "20002" {
+			t.Fatal("pickPort() returned the current port")
+		}
+		seen[port] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("pickPort() hit %d of the other 3 ports", len(seen))
+	}
+	if port := (&remoteEndpoint{host: "h", minPort: 20000, maxPort: 20000}).pickPort("20000"); port != "20000" {
+		t.Errorf("pickPort() on a single port = %s", port)
+	}
+}
@@ -0,0 +1,278 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// Key rotation. kcp-go takes a single BlockCrypt, so with a key list the
+// sessions run without one and keyringConn does the same nonce and crc32
+// framing under the socket, trying every key on the way in. Packets stay
+// compatible with a peer that only knows one of the keys.
+//
+// New sessions send with the first key. Each peer is answered with the key
+// its packets last came in with, until that key is retired or the peer has
+// been quiet for peerExpiry. The keyring remembers that across sessions, and
+// a client whose server didn't answer moves on to the next key, the server
+// may not have the new one yet.
+
+const (
+	nonceSize       = 16
+	crcSize         = 4
+	cryptHeaderSize = nonceSize + crcSize
+)
+
+// how long the key a peer last used is remembered
+const peerExpiry = 10 * time.Minute
+
+var errKeyringOff = errors.New("key rotation is off, start with a key list")
+
+// keyring is the key list of the process, the first key is the primary
+type keyring struct {
+	lock   sync.RWMutex
+	crypt  string
+	keys   []string
+	blocks []kcp.BlockCrypt
+
+	peerLock sync.Mutex
+	peers    map[string]keyPeer // by peer ip
+	swept    time.Time
+}
+
+type keyPeer struct {
+	block kcp.BlockCrypt
+	seen  time.Time
+}
+
+// peerHost is what peers are told apart by, the port changes with hopping
+func peerHost(addr net.Addr) string {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP.String()
+	}
+	return addr.String()
+}
+
+var keyRing keyring
+
+// reset replaces the key list, the crypt name used is returned
+func (r *keyring) reset(crypt string, keys []string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys, r.blocks = nil, nil
+	for _, key := range keys {
+		var block kcp.BlockCrypt
+		block, crypt = blockCryptFor(crypt, key)
+		r.keys = append(r.keys, key)
+		r.blocks = append(r.blocks, block)
+	}
+	r.crypt = crypt
+	return crypt
+}
+
+func (r *keyring) primary() kcp.BlockCrypt {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.blocks) == 0 {
+		return nil
+	}
+	return r.blocks[0]
+}
+
+func (r *keyring) list() []kcp.BlockCrypt {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.blocks
+}
+
+func (r *keyring) has(block kcp.BlockCrypt) bool {
+	for _, b := range r.list() {
+		if b == block {
+			return true
+		}
+	}
+	return false
+}
+
+// blockFor is the key to send to host with
+func (r *keyring) blockFor(host string) kcp.BlockCrypt {
+	r.peerLock.Lock()
+	p, ok := r.peers[host]
+	r.peerLock.Unlock()
+	if ok && r.has(p.block) {
+		return p.block
+	}
+	return r.primary()
+}
+
+// heard notes the key a packet from host came in with, and forgets the
+// peers quiet for longer than peerExpiry now and then
+func (r *keyring) heard(host string, block kcp.BlockCrypt) {
+	now := time.Now()
+	r.peerLock.Lock()
+	defer r.peerLock.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[string]keyPeer)
+	}
+	r.peers[host] = keyPeer{block, now}
+	if now.Sub(r.swept) < peerExpiry/10 {
+		return
+	}
+	r.swept = now
+	for h, p := range r.peers {
+		if now.Sub(p.seen) > peerExpiry {
+			delete(r.peers, h)
+		}
+	}
+}
+
+// unanswered moves host on to the key after the one it was sent
+func (r *keyring) unanswered(host string) {
+	blocks := r.list()
+	if len(blocks) < 2 {
+		return
+	}
+	sent, next := r.blockFor(host), blocks[0]
+	for i, b := range blocks {
+		if b == sent {
+			next = blocks[(i+1)%len(blocks)]
+		}
+	}
+	r.heard(host, next)
+}
+
+// AddKey makes key the primary key for new sessions, the older keys are still
+// accepted until they are retired
+func AddKey(key string) error {
+	keyRing.lock.Lock()
+	defer keyRing.lock.Unlock()
+	if len(keyRing.keys) == 0 {
+		return errKeyringOff
+	}
+	keys := []string{key}
+	blocks := []kcp.BlockCrypt{nil}
+	blocks[0], _ = blockCryptFor(keyRing.crypt, key)
+	for i, k := range keyRing.keys {
+		if k != key {
+			keys = append(keys, k)
+			blocks = append(blocks, keyRing.blocks[i])
+		}
+	}
+	// copy on write, readers hold on to the old slices
+	keyRing.keys, keyRing.blocks = keys, blocks
+	return nil
+}
+
+// RetireKey stops accepting key, the next key becomes primary if it was the
+// primary one. The last key can't be retired.
+func RetireKey(key string) error {
+	keyRing.lock.Lock()
+	defer keyRing.lock.Unlock()
+	if len(keyRing.keys) == 0 {
+		return errKeyringOff
+	}
+	var keys []string
+	var blocks []kcp.BlockCrypt
+	for i, k := range keyRing.keys {
+		if k != key {
+			keys = append(keys, k)
+			blocks = append(blocks, keyRing.blocks[i])
+		}
+	}
+	if len(keys) == len(keyRing.keys) {
+		return errors.New("RetireKey(): unknown key")
+	}
+	if len(keys) == 0 {
+		return errors.New("RetireKey(): can't retire the last key")
+	}
+	keyRing.keys, keyRing.blocks = keys, blocks
+	return nil
+}
+
+// keyringConn encrypts the packets of a net.PacketConn with the keyring
+type keyringConn struct {
+	net.PacketConn
+	ring *keyring
+	rbuf []byte
+	dbuf []byte
+}
+
+func newKeyringConn(conn net.PacketConn, ring *keyring) *keyringConn {
+	return &keyringConn{
+		PacketConn: conn,
+		ring:       ring,
+		rbuf:       make([]byte, 65536),
+		dbuf:       make([]byte, 65536),
+	}
+}
+
+func (c *keyringConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := make([]byte, cryptHeaderSize+len(b))
+	if _, err := io.ReadFull(rand.Reader, buf[:nonceSize]); err != nil {
+		return 0, err
+	}
+	binary.LittleEndian.PutUint32(buf[nonceSize:], crc32.ChecksumIEEE(b))
+	copy(buf[cryptHeaderSize:], b)
+	c.ring.blockFor(peerHost(addr)).Encrypt(buf, buf)
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// open decrypts pkt into c.dbuf with the first key whose checksum matches,
+// starting with the one the peer used last
+func (c *keyringConn) open(pkt []byte, addr net.Addr) bool {
+	host := peerHost(addr)
+	tried := c.ring.blockFor(host)
+	try := func(block kcp.BlockCrypt) bool {
+		block.Decrypt(c.dbuf[:len(pkt)], pkt)
+		return binary.LittleEndian.Uint32(c.dbuf[nonceSize:]) == crc32.ChecksumIEEE(c.dbuf[cryptHeaderSize:len(pkt)])
+	}
+	if tried != nil && try(tried) {
+		c.ring.heard(host, tried)
+		return true
+	}
+	for _, block := range c.ring.list() {
+		if block != tried && try(block) {
+			c.ring.heard(host, block)
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFrom drops packets no key opens, like kcp-go does on a bad checksum
+func (c *keyringConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < cryptHeaderSize || !c.open(c.rbuf[:n], addr) {
+			continue
+		}
+		return copy(b, c.dbuf[cryptHeaderSize:n]), addr, nil
+	}
+}
+
+func (c *keyringConn) SetReadBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+func (c *keyringConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return nil
+}
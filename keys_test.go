@@ -0,0 +1,150 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+func testRing(blocks ...kcp.BlockCrypt) *keyring {
+	r := &keyring{blocks: blocks}
+	for range blocks {
+		r.keys = append(r.keys, "key")
+	}
+	return r
+}
+
+func keyringPair(t *testing.T, a, b *keyring) (*keyringConn, *keyringConn) {
+	ca, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ca.Close() })
+	cb, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cb.Close() })
+	ca.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cb.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return newKeyringConn(ca, a), newKeyringConn(cb, b)
+}
+
+// a server that rotated answers a client still on the old key with that key
+func TestKeyringConnOldKey(t *testing.T) {
+	oldKey, newKey := xorBlock(1), xorBlock(2)
+	client, server := keyringPair(t, testRing(oldKey), testRing(newKey, oldKey))
+
+	buf := make([]byte, 64)
+	client.WriteTo([]byte("ping"), server.LocalAddr())
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("server ReadFrom() = %q, %v", buf[:n], err)
+	}
+	server.WriteTo([]byte("pong"), addr)
+	if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("client ReadFrom() = %q, %v", buf[:n], err)
+	}
+}
+
+func TestKeyringConnDropsUnknownKey(t *testing.T) {
+	client, server := keyringPair(t, testRing(xorBlock(3)), testRing(xorBlock(1)))
+	client.WriteTo([]byte("ping"), server.LocalAddr())
+	server.PacketConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := server.ReadFrom(make([]byte, 64)); err == nil {
+		t.Error("a packet of an unknown key got through")
+	}
+}
+
+func TestKeyringUnanswered(t *testing.T) {
+	r := testRing(xorBlock(1), xorBlock(2))
+	if r.blockFor("192.0.2.1") != xorBlock(1) {
+		t.Fatal("a new peer isn't sent the primary key")
+	}
+	r.unanswered("192.0.2.1")
+	if r.blockFor("192.0.2.1") != xorBlock(2) {
+		t.Error("an unanswered peer wasn't moved on to the older key")
+	}
+	r.unanswered("192.0.2.1")
+	if r.blockFor("192.0.2.1") != xorBlock(1) {
+		t.Error("the keys didn't wrap around")
+	}
+	if r.blockFor("192.0.2.2") != xorBlock(1) {
+		t.Error("another peer was moved on too")
+	}
+}
+
+// the state is shared, a new session starts with what the last one learned
+func TestKeyringSharedAcrossConns(t *testing.T) {
+	r := testRing(xorBlock(1), xorBlock(2))
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	r.unanswered(peerHost(server.LocalAddr()))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	newKeyringConn(conn, r).WriteTo([]byte("ping"), server.LocalAddr())
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, n)
+	xorBlock(2).Decrypt(plain, buf[:n])
+	if string(plain[cryptHeaderSize:]) != "ping" {
+		t.Error("a new conn didn't send with the key the keyring moved on to")
+	}
+}
+
+func TestKeyringPeerExpiry(t *testing.T) {
+	r := testRing(xorBlock(1), xorBlock(2))
+	r.peers = map[string]keyPeer{"192.0.2.1": {xorBlock(2), time.Now().Add(-2 * peerExpiry)}}
+	r.heard("192.0.2.2", xorBlock(2))
+	if _, ok := r.peers["192.0.2.1"]; ok {
+		t.Error("a quiet peer wasn't forgotten")
+	}
+	if r.blockFor("192.0.2.2") != xorBlock(2) {
+		t.Error("a peer heard just now was forgotten")
+	}
+}
+
+func TestKeyringRetiredPeerKey(t *testing.T) {
+	r := testRing(xorBlock(1), xorBlock(2))
+	r.heard("192.0.2.1", xorBlock(2))
+	r.keys, r.blocks = r.keys[:1], r.blocks[:1]
+	if r.blockFor("192.0.2.1") != xorBlock(1) {
+		t.Error("a peer is still sent a retired key")
+	}
+}
+
+func TestAddRetireKey(t *testing.T) {
+	saved := keyRing.keys
+	defer func() { keyRing.keys, keyRing.blocks = saved, nil }()
+
+	keyRing.keys, keyRing.blocks = nil, nil
+	if err := AddKey("k2"); err != errKeyringOff {
+		t.Errorf("AddKey() = %v without key rotation", err)
+	}
+	keyRing.keys, keyRing.blocks = []string{"k1"}, []kcp.BlockCrypt{xorBlock(1)}
+	if err := AddKey("k2"); err != nil || len(keyRing.keys) != 2 || keyRing.keys[0] != "k2" {
+		t.Fatalf("AddKey() = %v, keys %q", err, keyRing.keys)
+	}
+	if err := RetireKey("k2"); err != nil || len(keyRing.keys) != 1 || keyRing.keys[0] != "k1" {
+		t.Fatalf("RetireKey() = %v, keys %q", err, keyRing.keys)
+	}
+	if err := RetireKey("k1"); err == nil {
+		t.Error("RetireKey() retired the last key")
+	}
+	if err := RetireKey("k9"); err == nil {
+		t.Error("RetireKey() retired an unknown key")
+	}
+}
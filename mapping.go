@@ -0,0 +1,92 @@
+package kcp
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Port mappings let one set of sessions carry several services. Once any
+// mapping is configured every stream starts with a header naming its target,
+// an empty name is the default target of the server, so both ends must be
+// set up with mappings alike.
+
+// Mapping maps a local tcp address to a target named on the server, its own
+// allow and deny lists replace the ones of Config when either is set
+type Mapping struct {
+	Local  string   `json:"local"`
+	Target string   `json:"target"`
+	Allow  []string `json:"allow"`
+	Deny   []string `json:"deny"`
+}
+
+const maxTargetName = 255
+
+// parseMapping parses a mapping like 127.0.0.1:2222=ssh
+func parseMapping(s string) (Mapping, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return Mapping{}, errors.Errorf("mapping %q is not like localaddr=target", s)
+	}
+	return Mapping{Local: kv[0], Target: kv[1]}, nil
+}
+
+func checkMappings(mappings []Mapping) error {
+	for _, m := range mappings {
+		if err := checkLocalAddr(m.Local); err != nil {
+			return errors.Wrap(err, "mapping")
+		}
+		if m.Target == "" || len(m.Target) > maxTargetName {
+			return errors.Errorf("mapping %s: target name must be 1 to %d bytes", m.Local, maxTargetName)
+		}
+	}
+	return nil
+}
+
+// writeStreamHeader names the target of a stream, a length byte followed by
+// the name
+func writeStreamHeader(w io.Writer, target string) error {
+	if len(target) > maxTargetName {
+		return errors.Errorf("target name %q too long", target)
+	}
+	_, err := w.Write(append([]byte{byte(len(target))}, target...))
+	return err
+}
+
+func readStreamHeader(r io.Reader) (string, error) {
+	buf := make([]byte, 1+maxTargetName)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+	n := int(buf[0])
+	if _, err := io.ReadFull(r, buf[1:1+n]); err != nil {
+		return "", err
+	}
+	return string(buf[1 : 1+n]), nil
+}
+
+// routeTo returns a stream handler that connects every stream to the target
+// named in its header, the unnamed ones go to fallback
+func routeTo(fallback string, targets map[string]string) func(stream net.Conn) {
+	return func(p1 net.Conn) {
+		name, err := readStreamHeader(p1)
+		if err != nil {
+			log.Println("routeTo:", err)
+			p1.Close()
+			return
+		}
+		target := fallback
+		if name != "" {
+			var ok bool
+			if target, ok = targets[name]; !ok {
+				log.Println("routeTo: unknown target", name)
+				p1.Close()
+				return
+			}
+		}
+		pipeTo(target)(p1)
+	}
+}
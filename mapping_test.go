@@ -0,0 +1,107 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMapping(t *testing.T) {
+	m, err := parseMapping("127.0.0.1:2222=ssh")
+	if err != nil || m.Local != "127.0.0.1:2222" || m.Target != "ssh" {
+		t.Errorf("parseMapping() = %+v, %v", m, err)
+	}
+	for _, s := range []string{"127.0.0.1:2222", "=ssh", "127.0.0.1:2222="} {
+		if _, err := parseMapping(s); err == nil {
+			t.Errorf("parseMapping(%q): no error", s)
+		}
+	}
+}
+
+func TestCheckMappings(t *testing.T) {
+	good := []Mapping{{Local: "127.0.0.1:2222", Target: "ssh"}, {Local: "unix:/tmp/web.sock", Target: "web"}}
+	if err := checkMappings(good); err != nil {
+		t.Error(err)
+	}
+	for _, m := range []Mapping{
+		{Local: "127.0.0.1", Target: "ssh"},
+		{Local: "127.0.0.1:2222", Target: ""},
+		{Local: "127.0.0.1:2222", Target: strings.Repeat("x", maxTargetName+1)},
+	} {
+		if err := checkMappings([]Mapping{m}); err == nil {
+			t.Errorf("checkMappings(%+v): no error", m)
+		}
+	}
+}
+
+func TestStreamHeader(t *testing.T) {
+	for _, target := range []string{"", "ssh", strings.Repeat("x", maxTargetName)} {
+		var buf bytes.Buffer
+		if err := writeStreamHeader(&buf, target); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+		got, err := readStreamHeader(&buf)
+		if err != nil || got != target {
+			t.Errorf("readStreamHeader() = %q, %v, want %q", got, err, target)
+		}
+		if buf.String() != "payload" {
+			t.Errorf("the header ate into the stream: %q left", buf.String())
+		}
+	}
+	if err := writeStreamHeader(ioutil.Discard, strings.Repeat("x", maxTargetName+1)); err == nil {
+		t.Error("writeStreamHeader() wrote a name that doesn't fit the length byte")
+	}
+	if _, err := readStreamHeader(bytes.NewReader([]byte{5, 's', 's'})); err == nil {
+		t.Error("readStreamHeader() accepted a short name")
+	}
+}
+
+// greeter accepts one connection and writes name to it
+func greeter(t *testing.T, name string) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestRouteTo(t *testing.T) {
+	handle := routeTo(greeter(t, "default"), map[string]string{"ssh": greeter(t, "ssh")})
+	for _, target := range []string{"ssh", ""} {
+		client, server := net.Pipe()
+		go handle(server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go writeStreamHeader(client, target)
+		got, _ := ioutil.ReadAll(client)
+		client.Close()
+		want := target
+		if want == "" {
+			want = "default"
+		}
+		if string(got) != want {
+			t.Errorf("stream for %q reached %q", target, got)
+		}
+	}
+
+	// an unknown name is closed without reaching any target
+	client, server := net.Pipe()
+	go handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go writeStreamHeader(client, "smtp")
+	if n, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("Read() = %d, %v, want the stream closed", n, err)
+	}
+}
@@ -0,0 +1,271 @@
+package kcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// A tiny Prometheus text exposition, every sample carries a component label
+// naming the part of the tunnel it comes from.
+
+type collector struct {
+	name string
+	fn   func(w io.Writer)
+}
+
+var (
+	collectorsLock sync.Mutex
+	collectors     []collector
+)
+
+// registerCollector puts fn on the metrics page under name, fn writes
+// complete families. It replaces an earlier collector of the same name, so a
+// client started again in the same process doesn't report its families twice.
+func registerCollector(name string, fn func(w io.Writer)) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	for i := range collectors {
+		if collectors[i].name == name {
+			collectors[i].fn = fn
+			return
+		}
+	}
+	collectors = append(collectors, collector{name, fn})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders label pairs, e.g. labels("component", "kcp") is component="kcp"
+func labels(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+`="`+labelEscaper.Replace(kv[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name, labels string, value interface{}) {
+	fmt.Fprintf(w, "%s{%s} %v\n", name, labels, value)
+}
+
+// counterVec is a counter family keyed by rendered labels
+type counterVec struct {
+	name   string
+	help   string
+	lock   sync.Mutex
+	values map[string]*uint64
+}
+
+func newCounterVec(name, help string) *counterVec {
+	c := &counterVec{name: name, help: help, values: make(map[string]*uint64)}
+	registerCollector(name, c.write)
+	return c
+}
+
+func (c *counterVec) add(labels string, n uint64) {
+	c.lock.Lock()
+	v, ok := c.values[labels]
+	if !ok {
+		v = new(uint64)
+		c.values[labels] = v
+	}
+	c.lock.Unlock()
+	atomic.AddUint64(v, n)
+}
+
+func (c *counterVec) inc(labels string) {
+	c.add(labels, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.values) == 0 {
+		return
+	}
+	writeHeader(w, c.name, "counter", c.help)
+	for _, l := range sortedKeys(c.values) {
+		writeSample(w, c.name, l, atomic.LoadUint64(c.values[l]))
+	}
+}
+
+// histogramVec is a histogram family keyed by rendered labels
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64) *histogramVec {
+	h := &histogramVec{name: name, help: help, buckets: buckets, values: make(map[string]*histogram)}
+	registerCollector(name, h.write)
+	return h
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	o, ok := h.values[labels]
+	if !ok {
+		o = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = o
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			o.counts[i]++
+			break
+		}
+	}
+	o.sum += v
+	o.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.values) == 0 {
+		return
+	}
+	writeHeader(w, h.name, "histogram", h.help)
+	for _, l := range sortedKeys(h.values) {
+		o := h.values[l]
+		sep := ""
+		if l != "" {
+			sep = ","
+		}
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += o.counts[i]
+			writeSample(w, h.name+"_bucket", l+sep+`le="`+fmt.Sprint(le)+`"`, cumulative)
+		}
+		writeSample(w, h.name+"_bucket", l+sep+`le="+Inf"`, o.count)
+		writeSample(w, h.name+"_sum", l, o.sum)
+		writeSample(w, h.name+"_count", l, o.count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	connectLatency = newHistogramVec("shadowsocks_connect_duration_seconds",
+		"Time to connect to a shadowsocks server.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+	udpRelayPackets = newCounterVec("udp_relay_packets_total",
+		"Datagrams relayed by the socks5 udp associate.")
+	httpProxyRequests = newCounterVec("http_proxy_requests_total",
+		"Requests served by the http proxy.")
+)
+
+func init() {
+	registerCollector("kcp_snmp", writeSnmp)
+	registerCollector("shadowsocks_servers", writeServers)
+}
+
+// snmpGauges are the kcp.Snmp fields that go up and down
+var snmpGauges = map[string]bool{"MaxConn": true, "CurrEstab": true}
+
+// snakeCase turns a kcp.Snmp header like FECRecovered into fec_recovered
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) ||
+			i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func writeSnmp(w io.Writer) {
+	snmp := kcp.DefaultSnmp.Copy()
+	header, values := snmp.Header(), snmp.ToSlice()
+	for i := range header {
+		name, typ := "kcp_"+snakeCase(header[i]), "gauge"
+		if !snmpGauges[header[i]] {
+			name, typ = name+"_total", "counter"
+		}
+		writeHeader(w, name, typ, "kcp-go snmp counter "+header[i]+".")
+		writeSample(w, name, labels("component", "kcp"), values[i])
+	}
+}
+
+func writeServers(w io.Writer) {
+	servers.failLock.Lock()
+	defer servers.failLock.Unlock()
+	if len(servers.failCnt) == 0 {
+		return
+	}
+	writeHeader(w, "shadowsocks_server_fail_count", "gauge", "Recent failed connections to a shadowsocks server.")
+	for i, se := range servers.srvCipher {
+		writeSample(w, "shadowsocks_server_fail_count", labels("component", "shadowsocks", "server", se.server), servers.failCnt[i])
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	collectorsLock.Lock()
+	for _, c := range collectors {
+		c.fn(bw)
+	}
+	collectorsLock.Unlock()
+	bw.Flush()
+}
+
+var metricsOnce sync.Once
+
+// serveMetrics serves the metrics page at http://addr/metrics, only the
+// first call in a process starts a listener
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	metricsOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", handleMetrics)
+		log.Println("metrics listening on:", addr)
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Println("metrics:", err)
+			}
+		}()
+	})
+}
@@ -0,0 +1,117 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	got := labels("component", "kcp", "server", "a\"b\\c\nd")
+	want := `component="kcp",server="a\"b\\c\nd"`
+	if got != want {
+		t.Errorf("labels() = %s, want %s", got, want)
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"BytesSent":    "bytes_sent",
+		"FECRecovered": "fec_recovered",
+		"CurrEstab":    "curr_estab",
+		"RetransSegs":  "retrans_segs",
+	} {
+		if got := snakeCase(in); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_counter_total", "A test counter.")
+	c.inc(labels("dir", "up"))
+	c.add(labels("dir", "up"), 2)
+	var buf bytes.Buffer
+	c.write(&buf)
+	out := buf.String()
+	if !strings.Contains(out, "# TYPE test_counter_total counter\n") ||
+		!strings.Contains(out, `test_counter_total{dir="up"} 3`+"\n") {
+		t.Errorf("write() = %q", out)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1})
+	h.observe("", 0.05)
+	h.observe("", 0.5)
+	h.observe("", 5)
+	var buf bytes.Buffer
+	h.write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		`test_seconds_count{} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("write() has no %s in %q", want, out)
+		}
+	}
+}
+
+// a client started twice in one process reports its families once
+func TestRegisterCollectorReplaces(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		registerCollector("test_twice", func(w io.Writer) {
+			writeHeader(w, "test_twice_up", "gauge", "Registered twice.")
+		})
+	}
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if n := strings.Count(rec.Body.String(), "# TYPE test_twice_up "); n != 1 {
+		t.Errorf("test_twice_up reported %d times", n)
+	}
+}
+
+// the metrics page reads the fail counts the dial path writes, go test -race
+func TestServersFailCount(t *testing.T) {
+	servers.failLock.Lock()
+	servers.srvCipher = []*ServerCipher{{server: "127.0.0.1:8388"}}
+	servers.failCnt = make([]int, 1)
+	servers.failLock.Unlock()
+	defer func() {
+		servers.failLock.Lock()
+		servers.srvCipher, servers.failCnt = nil, nil
+		servers.failLock.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			countFailure(0, true)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		writeServers(&buf)
+	}
+	wg.Wait()
+	if n := failCount(0); n != maxFailCnt {
+		t.Errorf("failCount() = %d, want the cap %d", n, maxFailCnt)
+	}
+	var buf bytes.Buffer
+	writeServers(&buf)
+	if want := `shadowsocks_server_fail_count{component="shadowsocks",server="127.0.0.1:8388"} 30`; !strings.Contains(buf.String(), want) {
+		t.Errorf("writeServers() = %q", buf.String())
+	}
+	countFailure(0, false)
+	if n := failCount(0); n != 0 {
+		t.Errorf("failCount() = %d after a good connection", n)
+	}
+}
@@ -0,0 +1,189 @@
+package kcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// The socks listener also speaks http proxy, a first byte other than a socks
+// version is taken for an http request. CONNECT and plain requests go straight
+// to the shadowsocks servers instead of through StartHttpProxy and the socks
+// port. Plain requests are served one after another on a kept-alive
+// connection, a request for another host gets a new server connection.
+
+// hostRawAddr turns host:port into a socks5 raw address
+func hostRawAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errSocks4Field
+		}
+		raw = append([]byte{socksAtypDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		raw = append([]byte{socksAtypIPv4}, ip4...)
+	} else {
+		raw = append([]byte{socksAtypIPv6}, ip.To16()...)
+	}
+	return append(raw, byte(port>>8), byte(port)), nil
+}
+
+// proxyAuthorized checks the basic credentials of a request against the
+// socks users, anyone passes when there are none
+func proxyAuthorized(req *http.Request) bool {
+	if len(socksUsers) == 0 {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return false
+	}
+	kv := strings.SplitN(string(b), ":", 2)
+	if len(kv) != 2 {
+		return false
+	}
+	want, ok := socksUsers[kv[0]]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(kv[1])) == 1
+}
+
+// handleHTTP serves an http proxy client whose first byte has been read
+func handleHTTP(conn net.Conn, first byte) {
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), conn))
+	var remote net.Conn
+	var rbr *bufio.Reader
+	var remoteAddr string
+	defer func() {
+		if remote != nil {
+			remote.Close()
+		}
+	}()
+	for {
+		ss.SetReadTimeout(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if remote == nil || err != io.EOF {
+				log.Println("http proxy request:", err)
+			}
+			return
+		}
+		httpProxyRequests.inc(labels("component", "mixed", "method", req.Method))
+		if !proxyAuthorized(req) {
+			log.Printf("http proxy authentication failed from %v\n", conn.RemoteAddr())
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+
+		addr := req.Host
+		if req.Method != http.MethodConnect && req.URL.Host != "" {
+			addr = req.URL.Host
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "80")
+		}
+		if remote != nil && addr != remoteAddr {
+			// the next request is for another host
+			remote.Close()
+			remote = nil
+		}
+		if remote == nil {
+			rawaddr, err := hostRawAddr(addr)
+			if err != nil {
+				log.Println("http proxy:", addr, err)
+				io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			if remote, err = createServerConn(rawaddr, addr); err != nil {
+				log.Println("http proxy:", addr, err)
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			rbr = bufio.NewReader(remote)
+			remoteAddr = addr
+		}
+
+		if req.Method == http.MethodConnect {
+			if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				return
+			}
+			pipeHTTP(conn, br, remote)
+			return
+		}
+		if !forwardHTTP(conn, br, remote, rbr, req) {
+			return
+		}
+	}
+}
+
+// forwardHTTP sends a plain request to remote and copies the response back,
+// it reports whether the connection can take another request
+func forwardHTTP(conn net.Conn, br *bufio.Reader, remote net.Conn, rbr *bufio.Reader, req *http.Request) bool {
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	if err := req.Write(remote); err != nil {
+		log.Println("http proxy:", req.Host, err)
+		return false
+	}
+	for {
+		resp, err := http.ReadResponse(rbr, req)
+		if err != nil {
+			log.Println("http proxy response:", req.Host, err)
+			return false
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return false
+		}
+		switch {
+		case resp.StatusCode == http.StatusSwitchingProtocols:
+			// the connection belongs to the upgraded protocol from here
+			if n := rbr.Buffered(); n > 0 {
+				pending, _ := rbr.Peek(n)
+				if _, err := conn.Write(pending); err != nil {
+					return false
+				}
+			}
+			pipeHTTP(conn, br, remote)
+			return false
+		case resp.StatusCode >= 100 && resp.StatusCode < 200:
+			// 100 Continue and the like, the final response follows
+			continue
+		}
+		return !req.Close && !resp.Close
+	}
+}
+
+// pipeHTTP relays conn and remote both ways, starting with whatever the
+// client sent ahead that br holds
+func pipeHTTP(conn net.Conn, br *bufio.Reader, remote net.Conn) {
+	if n := br.Buffered(); n > 0 {
+		pending, _ := br.Peek(n)
+		if _, err := remote.Write(pending); err != nil {
+			return
+		}
+	}
+	go ss.PipeThenClose(conn, remote)
+	ss.PipeThenClose(remote, conn)
+}
@@ -0,0 +1,286 @@
+package kcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// directCipher connects to the target itself in place of a shadowsocks
+// server
+type directCipher struct{}
+
+func (directCipher) dial(rawaddr []byte, server string) (net.Conn, error) {
+	addr, _, err := parseSocksAddr(rawaddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", addr)
+}
+
+func (directCipher) packetConn(pc net.PacketConn, ota bool) packetCipher {
+	return nil
+}
+
+func withDirectServer(t *testing.T) {
+	saved := servers.srvCipher
+	servers.srvCipher = []*ServerCipher{{"direct", directCipher{}}}
+	servers.failCnt = make([]int, 1)
+	t.Cleanup(func() {
+		// handlers of the test may still count their connection
+		servers.failLock.Lock()
+		servers.srvCipher, servers.failCnt = saved, make([]int, len(saved))
+		servers.failLock.Unlock()
+	})
+}
+
+// mixedListener serves handleConnection on loopback
+func mixedListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func tcpEchoServer(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func dialMixed(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// expectEcho checks that r echoes what goes into w
+func expectEcho(t *testing.T, w io.Writer, r io.Reader) {
+	t.Helper()
+	w.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestMixedSniff(t *testing.T) {
+	withDirectServer(t)
+	withSocksUsers(t, nil)
+	mixed := mixedListener(t)
+	echo := tcpEchoServer(t)
+	port := []byte{byte(echo.Port >> 8), byte(echo.Port)}
+
+	t.Run("socks4", func(t *testing.T) {
+		conn := dialMixed(t, mixed)
+		conn.Write(append(append([]byte{socksVer4, socks4CmdConnect}, port...), 127, 0, 0, 1, 0))
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks4Granted {
+			t.Fatalf("reply %v, %v", reply, err)
+		}
+		expectEcho(t, conn, conn)
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := dialMixed(t, mixed)
+		conn.Write([]byte{socksVer5, 1, socksMethodNone})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksMethodNone {
+			t.Fatalf("method reply %v, %v", reply, err)
+		}
+		conn.Write(append([]byte{socksVer5, 1, 0, socksAtypIPv4, 127, 0, 0, 1}, port...))
+		reply = make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksRepSucceeded {
+			t.Fatalf("reply %v, %v", reply, err)
+		}
+		expectEcho(t, conn, conn)
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn := dialMixed(t, mixed)
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", echo)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT: %v, %v", resp, err)
+		}
+		expectEcho(t, conn, br)
+	})
+
+	t.Run("plain", func(t *testing.T) {
+		web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path)
+		}))
+		defer web.Close()
+		conn := dialMixed(t, mixed)
+		req, _ := http.NewRequest("GET", web.URL+"/plain", nil)
+		req.WriteProxy(conn)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "/plain" {
+			t.Errorf("body %q", body)
+		}
+	})
+}
+
+// countingServer is a web server that counts the connections it gets
+func countingServer(t *testing.T, conns *int32) *httptest.Server {
+	web := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	web.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	web.Start()
+	t.Cleanup(web.Close)
+	return web
+}
+
+func TestHTTPKeepAlive(t *testing.T) {
+	withDirectServer(t)
+	withSocksUsers(t, nil)
+	var conns1, conns2 int32
+	web1, web2 := countingServer(t, &conns1), countingServer(t, &conns2)
+	conn := dialMixed(t, mixedListener(t))
+	br := bufio.NewReader(conn)
+
+	get := func(web *httptest.Server, path string, close bool) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", web.URL+path, nil)
+		req.Close = close
+		req.WriteProxy(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != path {
+			t.Errorf("GET %s: body %q", path, body)
+		}
+	}
+	get(web1, "/a1", false)
+	get(web1, "/a2", false)
+	if n := atomic.LoadInt32(&conns1); n != 1 {
+		t.Errorf("%d connections for two requests to the same host", n)
+	}
+	get(web2, "/b1", false)
+	get(web1, "/a3", true)
+	if n := atomic.LoadInt32(&conns2); n != 1 {
+		t.Errorf("%d connections to the second host", n)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("after Connection: close, read %v", err)
+	}
+}
+
+// after 101 Switching Protocols the connection is relayed as is
+func TestHTTPUpgrade(t *testing.T) {
+	withDirectServer(t)
+	withSocksUsers(t, nil)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, rw)
+	}))
+	defer web.Close()
+
+	conn := dialMixed(t, mixedListener(t))
+	req, _ := http.NewRequest("GET", web.URL+"/echo", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	req.WriteProxy(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: %v, %v", resp, err)
+	}
+	expectEcho(t, conn, br)
+}
+
+func TestHTTPProxyAuthorization(t *testing.T) {
+	withDirectServer(t)
+	withSocksUsers(t, map[string]string{"alice": "secret"})
+	mixed := mixedListener(t)
+	echo := tcpEchoServer(t)
+
+	for auth, want := range map[string]int{
+		"":                 http.StatusProxyAuthRequired,
+		"alice:guess":      http.StatusProxyAuthRequired,
+		"alice:secret":     http.StatusOK,
+		"alice:secret:etc": http.StatusProxyAuthRequired,
+	} {
+		conn := dialMixed(t, mixed)
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n", echo)
+		if auth != "" {
+			fmt.Fprintf(conn, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+		io.WriteString(conn, "\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != want {
+			t.Errorf("%q: %v, %v, want %d", auth, resp, err, want)
+		}
+	}
+}
+
+func TestHostRawAddr(t *testing.T) {
+	for addr, want := range map[string][]byte{
+		"192.0.2.1:80":   {socksAtypIPv4, 192, 0, 2, 1, 0, 80},
+		"[::1]:443":      append(append([]byte{socksAtypIPv6}, net.ParseIP("::1")...), 1, 187),
+		"example.org:80": append(append([]byte{socksAtypDomain, 11}, "example.org"...), 0, 80),
+	} {
+		if got, err := hostRawAddr(addr); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("hostRawAddr(%q) = %v, %v", addr, got, err)
+		}
+	}
+	for _, addr := range []string{"example.org", "example.org:http", "example.org:70000"} {
+		if _, err := hostRawAddr(addr); err == nil {
+			t.Errorf("hostRawAddr(%q): no error", addr)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package kcp
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A network emulator in the spirit of linux netem, for reproducing bad links
+// on one box. Each direction of a wrapped socket is impaired on its own.
+
+// netemConfig describes the impairments of one direction
+type netemConfig struct {
+	loss      float64       // probability a packet is dropped
+	latency   time.Duration // fixed delay
+	jitter    time.Duration // random extra delay in [0, jitter)
+	reorder   float64       // probability a packet skips the delay and overtakes the queue
+	duplicate float64       // probability a packet is delivered twice
+	rate      int           // bandwidth cap in bytes per second, 0 for none
+}
+
+var errNetemTimeout = &net.OpError{Op: "read", Net: "netem", Err: timeoutError{}}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// parseNetem parses a spec like "loss=10%,latency=50ms,jitter=10ms,reorder=1%,duplicate=1%,rate=1m",
+// rate is in bytes per second with an optional k or m suffix
+func parseNetem(spec string) (*netemConfig, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	cfg := new(netemConfig)
+	for _, opt := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("netem: option %s is not like key=value", opt)
+		}
+		var err error
+		switch kv[0] {
+		case "loss":
+			cfg.loss, err = parsePercent(kv[1])
+		case "latency":
+			cfg.latency, err = time.ParseDuration(kv[1])
+		case "jitter":
+			cfg.jitter, err = time.ParseDuration(kv[1])
+		case "reorder":
+			cfg.reorder, err = parsePercent(kv[1])
+		case "duplicate":
+			cfg.duplicate, err = parsePercent(kv[1])
+		case "rate":
+			cfg.rate, err = parseRate(kv[1])
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "netem: "+opt)
+		}
+	}
+	return cfg, nil
+}
+
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, errors.New("not a percentage")
+	}
+	return v / 100, nil
+}
+
+func parseRate(s string) (int, error) {
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		unit, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "m"):
+		unit, s = 1<<20, s[:len(s)-1]
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, errors.New("not a rate")
+	}
+	return v * unit, nil
+}
+
+// netemPath is the impairment state of one direction
+type netemPath struct {
+	cfg  *netemConfig
+	lock sync.Mutex
+	rng  *rand.Rand
+	busy time.Time // when the rate limited link is free again
+}
+
+func newNetemPath(cfg *netemConfig) *netemPath {
+	return &netemPath{cfg: cfg, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// schedule returns when each copy of a packet of size bytes leaves, none if
+// the packet is lost
+func (p *netemPath) schedule(size int) []time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.rng.Float64() < p.cfg.loss {
+		return nil
+	}
+
+	var delay time.Duration
+	if p.cfg.rate > 0 {
+		now := time.Now()
+		if p.busy.Before(now) {
+			p.busy = now
+		}
+		p.busy = p.busy.Add(time.Duration(size) * time.Second / time.Duration(p.cfg.rate))
+		delay = p.busy.Sub(now)
+	}
+	if p.rng.Float64() >= p.cfg.reorder {
+		delay += p.cfg.latency
+		if p.cfg.jitter > 0 {
+			delay += time.Duration(p.rng.Int63n(int64(p.cfg.jitter)))
+		}
+	}
+
+	delays := []time.Duration{delay}
+	if p.rng.Float64() < p.cfg.duplicate {
+		delays = append(delays, delay)
+	}
+	return delays
+}
+
+type netemPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// netemConn impairs the packets written to and read from a net.PacketConn
+type netemConn struct {
+	net.PacketConn
+	out, in *netemPath
+
+	readOnce sync.Once
+	queue    chan netemPacket
+	die      chan struct{}
+	dieOnce  sync.Once
+	readErr  error
+
+	deadlineLock sync.Mutex
+	deadline     time.Time
+}
+
+// newNetemConn impairs both directions of conn as described by cfg
+func newNetemConn(conn net.PacketConn, cfg *netemConfig) *netemConn {
+	return &netemConn{
+		PacketConn: conn,
+		out:        newNetemPath(cfg),
+		in:         newNetemPath(cfg),
+		queue:      make(chan netemPacket, 1024),
+		die:        make(chan struct{}),
+	}
+}
+
+func (c *netemConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for _, delay := range c.out.schedule(len(b)) {
+		if delay == 0 {
+			if _, err := c.PacketConn.WriteTo(b, addr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		pkt := append([]byte(nil), b...)
+		time.AfterFunc(delay, func() { c.PacketConn.WriteTo(pkt, addr) })
+	}
+	return len(b), nil
+}
+
+// readLoop moves packets from the socket to the queue through the impairments
+func (c *netemConn) readLoop() {
+	for {
+		buf := make([]byte, 65536)
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			c.readErr = err
+			c.dieOnce.Do(func() { close(c.die) })
+			return
+		}
+		pkt := netemPacket{buf[:n], addr}
+		for _, delay := range c.in.schedule(n) {
+			if delay == 0 {
+				c.deliver(pkt)
+			} else {
+				time.AfterFunc(delay, func() { c.deliver(pkt) })
+			}
+		}
+	}
+}
+
+// deliver queues pkt for ReadFrom, a full queue drops it like a full buffer would
+func (c *netemConn) deliver(pkt netemPacket) {
+	select {
+	case c.queue <- pkt:
+	case <-c.die:
+	default:
+	}
+}
+
+func (c *netemConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readOnce.Do(func() { go c.readLoop() })
+
+	c.deadlineLock.Lock()
+	deadline := c.deadline
+	c.deadlineLock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.queue:
+		return copy(b, pkt.b), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, c.readErr
+	case <-timeout:
+		return 0, nil, errNetemTimeout
+	}
+}
+
+func (c *netemConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.deadline = t
+	c.deadlineLock.Unlock()
+	return nil
+}
+
+func (c *netemConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.PacketConn.SetWriteDeadline(t)
+}
@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseNetem(t *testing.T) {
+	cfg, err := parseNetem("loss=10%,latency=50ms,jitter=10ms,reorder=1%,duplicate=2%,rate=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := netemConfig{loss: 0.1, latency: 50 * time.Millisecond, jitter: 10 * time.Millisecond,
+		reorder: 0.01, duplicate: 0.02, rate: 1 << 20}
+	if *cfg != want {
+		t.Errorf("parseNetem() = %+v, want %+v", *cfg, want)
+	}
+	if cfg, err := parseNetem(""); cfg != nil || err != nil {
+		t.Error("parseNetem() impaired without a spec")
+	}
+	for _, spec := range []string{"loss", "loss=101%", "latency=fast", "rate=-1", "drop=1%"} {
+		if _, err := parseNetem(spec); err == nil {
+			t.Errorf("parseNetem(%q): no error", spec)
+		}
+	}
+}
+
+// netemPair is a plain sender and a receiver impaired by spec on loopback
+func netemPair(t *testing.T, spec string) (net.PacketConn, *netemConn) {
+	cfg, err := parseNetem(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sender.Close() })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := newNetemConn(conn, cfg)
+	t.Cleanup(func() { receiver.Close() })
+	return sender, receiver
+}
+
+func TestNetemLoss(t *testing.T) {
+	sender, receiver := netemPair(t, "loss=50%")
+	const sent = 400
+	counted := make(chan int)
+	go func() {
+		received := 0
+		buf := make([]byte, 16)
+		for {
+			receiver.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			if _, _, err := receiver.ReadFrom(buf); err != nil {
+				counted <- received
+				return
+			}
+			received++
+		}
+	}()
+	for i := 0; i < sent; i++ {
+		sender.WriteTo([]byte{byte(i)}, receiver.LocalAddr())
+		time.Sleep(100 * time.Microsecond) // keep under the socket buffer
+	}
+	received := <-counted
+	// binomial(400, 0.5) is inside 120..280 but for 1e-15 of runs
+	if received < sent*3/10 || received > sent*7/10 {
+		t.Errorf("received %d of %d packets at 50%% loss", received, sent)
+	}
+}
+
+func TestNetemDelay(t *testing.T) {
+	sender, receiver := netemPair(t, "latency=100ms")
+	start := time.Now()
+	sender.WriteTo([]byte("ping"), receiver.LocalAddr())
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("packet arrived after %v, want at least 100ms", elapsed)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("ReadFrom() = %q", buf[:n])
+	}
+}
+
+func TestNetemWriteLoss(t *testing.T) {
+	cfg, _ := parseNetem("loss=100%")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newNetemConn(conn, cfg)
+	defer sender.Close()
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	if n, err := sender.WriteTo([]byte("ping"), receiver.LocalAddr()); n != 4 || err != nil {
+		t.Fatalf("WriteTo() = %d, %v, a lost packet still counts as written", n, err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := receiver.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("a packet got through 100% loss")
+	}
+}
+
+func TestNetemReadDeadline(t *testing.T) {
+	_, receiver := netemPair(t, "latency=1s")
+	receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := receiver.ReadFrom(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("ReadFrom() = %v, want a timeout", err)
+	}
+}
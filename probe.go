@@ -0,0 +1,107 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// A new kcp session proves nothing, udp has no handshake and neither kcp nor
+// smux send anything before the first stream. A session is only up once the
+// server has answered: writeProbe sends a smux keepalive frame, the server's
+// kcp acknowledges it, and linkProbe sees that packet on the socket. A wrong
+// key gets no answer either, the server drops what it can't decrypt.
+
+// how long a new session may wait for the server's first packet
+const probeTimeout = 3 * time.Second
+
+var errNoReply = errors.New("no reply from the server")
+
+// smux frame of the probe: version, cmdNOP, length and stream id 0
+const smuxCmdNOP = 3
+
+// noReply reports whether err is only the server's silence, which a retry
+// may get past, rather than a local socket or resolve error
+func noReply(err error) bool {
+	return errors.Cause(err) == errNoReply
+}
+
+// linkProbe records when packets from the server come in on a socket
+type linkProbe struct {
+	net.PacketConn
+	last  int64 // unix nanoseconds of the latest packet
+	once  sync.Once
+	heard chan struct{}
+}
+
+func newLinkProbe(conn net.PacketConn) *linkProbe {
+	return &linkProbe{PacketConn: conn, heard: make(chan struct{})}
+}
+
+func (p *linkProbe) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := p.PacketConn.ReadFrom(b)
+	if err == nil {
+		atomic.StoreInt64(&p.last, time.Now().UnixNano())
+		p.once.Do(func() { close(p.heard) })
+	}
+	return n, addr, err
+}
+
+// silence is how long the server hasn't been heard from, forever if never
+func (p *linkProbe) silence() time.Duration {
+	last := atomic.LoadInt64(&p.last)
+	if last == 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(time.Now().UnixNano() - last)
+}
+
+// wait blocks until the server has been heard from, at most timeout
+func (p *linkProbe) wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.heard:
+		return nil
+	case <-timer.C:
+		return errNoReply
+	}
+}
+
+func (p *linkProbe) SetReadBuffer(bytes int) error {
+	if conn, ok := p.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+func (p *linkProbe) SetWriteBuffer(bytes int) error {
+	if conn, ok := p.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+// writeProbe writes a smux v1 keepalive frame to a session's stream before
+// smux takes it over, the server's smux ignores it
+func writeProbe(w io.Writer) error {
+	_, err := w.Write([]byte{1, smuxCmdNOP, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// probedSession is a smux session over kcp the server has answered on
+type probedSession struct {
+	session *smux.Session
+	probe   *linkProbe
+	fd      int    // fd of the udp socket
+	port    string // server port of a kcp session
+}
+
+func (s *probedSession) Close() error {
+	return s.session.Close()
+}
@@ -0,0 +1,105 @@
+package kcp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// echoServer answers every packet on a loopback socket
+func echoServer(t *testing.T) net.PacketConn {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+	return server
+}
+
+func TestLinkProbeAnswered(t *testing.T) {
+	server := echoServer(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	probe := newLinkProbe(conn)
+	if probe.silence() < time.Hour {
+		t.Errorf("silence() = %v before any packet", probe.silence())
+	}
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := probe.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := probe.WriteTo([]byte("ping"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := probe.wait(time.Second); err != nil {
+		t.Fatalf("wait(): %v", err)
+	}
+	if s := probe.silence(); s > time.Second {
+		t.Errorf("silence() = %v after an answer", s)
+	}
+}
+
+func TestLinkProbeBlackHole(t *testing.T) {
+	// a socket nobody reads, like a path that drops udp
+	hole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hole.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	probe := newLinkProbe(conn)
+	go func() {
+		buf := make([]byte, 2048)
+		probe.ReadFrom(buf)
+	}()
+	probe.WriteTo([]byte("ping"), hole.LocalAddr())
+	if err := probe.wait(200 * time.Millisecond); err != errNoReply {
+		t.Errorf("wait() = %v, want errNoReply", err)
+	}
+}
+
+func TestNoReply(t *testing.T) {
+	if !noReply(errors.Wrap(errNoReply, "createConn()")) {
+		t.Error("a wrapped probe timeout is not a missing reply")
+	}
+	if noReply(errors.Wrap(os.ErrPermission, "createConn()")) || noReply(nil) {
+		t.Error("a local error counts as a missing reply")
+	}
+}
+
+func TestWriteProbe(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeProbe(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{1, smuxCmdNOP, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("writeProbe() = %v, want %v", buf.Bytes(), want)
+	}
+}
@@ -0,0 +1,177 @@
+package kcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HAProxy PROXY protocol, https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+// The client may prepend a header with the address of the accepted client to
+// each stream, and the local listeners may take one from a load balancer.
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2Local  = 0x20
+	proxyV2Proxy  = 0x21
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+func checkProxyProtocol(version int) error {
+	if version < 0 || version > 2 {
+		return errors.Errorf("proxy protocol version %d, want 1, 2 or 0 to disable", version)
+	}
+	return nil
+}
+
+// writeProxyHeader writes a PROXY header of version for a connection from
+// src to dst, addresses other than tcp are sent as unknown
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok
+	v4 := known && s.IP.To4() != nil && d.IP.To4() != nil
+
+	var buf bytes.Buffer
+	switch version {
+	case 1:
+		switch {
+		case !known:
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		case v4:
+			buf.WriteString("PROXY TCP4 " + s.IP.To4().String() + " " + d.IP.To4().String() + " " +
+				strconv.Itoa(s.Port) + " " + strconv.Itoa(d.Port) + "\r\n")
+		default:
+			buf.WriteString("PROXY TCP6 " + s.IP.To16().String() + " " + d.IP.To16().String() + " " +
+				strconv.Itoa(s.Port) + " " + strconv.Itoa(d.Port) + "\r\n")
+		}
+	case 2:
+		buf.Write(proxyV2Sig)
+		switch {
+		case !known:
+			buf.Write([]byte{proxyV2Local, 0, 0, 0})
+		case v4:
+			buf.Write([]byte{proxyV2Proxy, proxyV2TCP4, 0, 12})
+			buf.Write(s.IP.To4())
+			buf.Write(d.IP.To4())
+		default:
+			buf.Write([]byte{proxyV2Proxy, proxyV2TCP6, 0, 36})
+			buf.Write(s.IP.To16())
+			buf.Write(d.IP.To16())
+		}
+		if known {
+			binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+			binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+		}
+	default:
+		return checkProxyProtocol(version)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// proxyConn is a connection whose remote address came from a PROXY header
+type proxyConn struct {
+	*bufferedConn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// rawConn is the accepted connection under a proxyConn, its addresses are
+// those of the load balancer's connection
+func rawConn(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.Conn
+	}
+	return conn
+}
+
+// readProxyHeader reads the v1 or v2 PROXY header a connection must start
+// with, the returned conn reports the client address it carries
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	remote := conn.RemoteAddr()
+	sig, err := br.Peek(6)
+	if err != nil {
+		return nil, errors.Wrap(err, "readProxyHeader()")
+	}
+	switch {
+	case string(sig) == "PROXY ":
+		remote, err = readProxyV1(br, remote)
+	case bytes.Equal(sig, proxyV2Sig[:6]):
+		remote, err = readProxyV2(br, remote)
+	default:
+		err = errors.New("no PROXY header")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "readProxyHeader()")
+	}
+	return &proxyConn{&bufferedConn{conn, br}, remote}, nil
+}
+
+func readProxyV1(br *bufio.Reader, remote net.Addr) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return remote, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("bad PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.Errorf("bad PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(br *bufio.Reader, remote net.Addr) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Sig) || header[12]>>4 != 2 {
+		return nil, errors.New("bad PROXY v2 signature")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if header[12] != proxyV2Proxy {
+		return remote, nil // LOCAL, the balancer's own connection
+	}
+	switch {
+	case header[13] == proxyV2TCP4 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case header[13] == proxyV2TCP6 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return remote, nil
+}
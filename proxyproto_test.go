@@ -0,0 +1,91 @@
+package kcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// headerConn is the server end of a pipe the client wrote b to
+func headerConn(t *testing.T, b []byte) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		client.Write(b)
+		client.Close()
+	}()
+	return server
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for _, src := range []*net.TCPAddr{
+			{IP: net.ParseIP("192.0.2.7").To4(), Port: 40000},
+			{IP: net.ParseIP("2001:db8::7"), Port: 40001},
+		} {
+			dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1").To4(), Port: 1080}
+			if src.IP.To4() == nil {
+				dst = &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1080}
+			}
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, src, dst); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("payload")
+			conn, err := readProxyHeader(headerConn(t, buf.Bytes()))
+			if err != nil {
+				t.Fatalf("v%d %v: %v", version, src, err)
+			}
+			got := conn.RemoteAddr().(*net.TCPAddr)
+			if !got.IP.Equal(src.IP) || got.Port != src.Port {
+				t.Errorf("v%d: RemoteAddr() = %v, want %v", version, got, src)
+			}
+			if rest, _ := ioutil.ReadAll(conn); string(rest) != "payload" {
+				t.Errorf("v%d: the header ate into the stream: %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestProxyHeaderUnknown(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		var buf bytes.Buffer
+		unix := &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}
+		if err := writeProxyHeader(&buf, version, unix, unix); err != nil {
+			t.Fatal(err)
+		}
+		raw := headerConn(t, buf.Bytes())
+		conn, err := readProxyHeader(raw)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		// the balancer's own connection keeps its address
+		if conn.RemoteAddr() != raw.RemoteAddr() {
+			t.Errorf("v%d: RemoteAddr() = %v, want the connection's own", version, conn.RemoteAddr())
+		}
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"no header":    []byte("GET / HTTP/1.1\r\n\r\n"),
+		"v1 bad ip":    []byte("PROXY TCP4 999.0.2.7 127.0.0.1 40000 1080\r\n"),
+		"v1 bad port":  []byte("PROXY TCP4 192.0.2.7 127.0.0.1 70000 1080\r\n"),
+		"v1 too long":  append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...),
+		"v2 truncated": append(append([]byte{}, proxyV2Sig...), proxyV2Proxy, proxyV2TCP4, 0, 12, 192),
+	} {
+		if _, err := readProxyHeader(headerConn(t, b)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestWriteProxyHeaderVersion(t *testing.T) {
+	if err := writeProxyHeader(ioutil.Discard, 3, nil, nil); err == nil {
+		t.Error("writeProxyHeader() wrote version 3")
+	}
+	if err := checkProxyProtocol(0); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,394 @@
+package kcp
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+	"golang.org/x/net/websocket"
+)
+
+// The server side of the tunnel, just enough of a kcptun server to test and
+// benchmark the client against on the local host.
+
+// serveSession hands every stream accepted on a server side session to handle
+func serveSession(conn io.ReadWriteCloser, smuxConfig *smux.Config, handle func(stream net.Conn)) {
+	session, err := smux.Server(conn, smuxConfig)
+	if err != nil {
+		log.Println("serveSession:", err)
+		conn.Close()
+		return
+	}
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go handle(stream)
+	}
+}
+
+// serveKCP sets up the sessions accepted on lis like the client does from
+// config and serves their streams
+func serveKCP(lis *kcp.Listener, config *Config, smuxConfig *smux.Config, handle func(stream net.Conn)) {
+	if err := lis.SetReadBuffer(config.SockBuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := lis.SetWriteBuffer(config.SockBuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
+	}
+	for {
+		conn, err := lis.AcceptKCP()
+		if err != nil {
+			log.Println("serveKCP:", err)
+			return
+		}
+		tuneKCP(conn, config)
+		go serveSession(compress(conn, config), smuxConfig, handle)
+	}
+}
+
+// serveStream serves smux sessions over the connections accepted on lis, the
+// server end of the tcp and tls transports
+func serveStream(lis net.Listener, config *Config, smuxConfig *smux.Config, handle func(stream net.Conn)) {
+	blocks := streamBlocks(config)
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Println("serveStream:", err)
+			return
+		}
+		go serveSession(compress(newCryptConn(conn, blocks()), config), smuxConfig, handle)
+	}
+}
+
+// serveWebSocket serves smux sessions over binary websockets upgraded at
+// path on lis, the server end of the ws and wss transports
+func serveWebSocket(lis net.Listener, path string, config *Config, smuxConfig *smux.Config, handle func(stream net.Conn)) {
+	blocks := streamBlocks(config)
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		serveSession(compress(newCryptConn(ws, blocks()), config), smuxConfig, handle)
+	}})
+	if err := http.Serve(lis, mux); err != nil {
+		log.Println("serveWebSocket:", err)
+	}
+}
+
+// pipeTo returns a stream handler that connects every stream to target
+func pipeTo(target string) func(stream net.Conn) {
+	return func(p1 net.Conn) {
+		p2, err := net.Dial("tcp", target)
+		if err != nil {
+			log.Println("pipeTo:", err)
+			p1.Close()
+			return
+		}
+		handleClient(p1, p2)
+	}
+}
+
+// serverConfig is the Config of a local test server, the tuning fields are
+// shared with the client
+type serverConfig struct {
+	Config
+	Listen    string            `json:"listen"`
+	Target    string            `json:"target"`
+	TCPListen string            `json:"tcplisten"`
+	TLSListen string            `json:"tlslisten"`
+	WSListen  string            `json:"wslisten"`
+	WSSListen string            `json:"wsslisten"`
+	WSPath    string            `json:"wspath"`
+	TLSCert   string            `json:"tlscert"`
+	TLSKey    string            `json:"tlskey"`
+	SSUDP     string            `json:"ssudp"`
+	SSMethod  string            `json:"ssmethod"`
+	SSPass    string            `json:"sspassword"`
+	Targets   map[string]string `json:"targets"`
+}
+
+// StartServer runs a server for the client on the local host, kcp plus the
+// optional tcp, tls, ws and wss transports, every stream is piped to target
+// or to the mapped target its header names.
+func StartServer() {
+	myApp := cli.NewApp()
+	myApp.Name = "kcptun"
+	myApp.Usage = "server(with SMUX) for local testing"
+	myApp.Version = VERSION
+	myApp.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen,l",
+			Value: ":38600",
+			Usage: "kcp server listen address",
+		},
+		cli.StringFlag{
+			Name:  "target, t",
+			Value: "127.0.0.1:8388",
+			Usage: "target server address",
+		},
+		cli.StringSliceFlag{
+			Name:  "map",
+			Usage: "name a target for client port mappings, like: ssh=127.0.0.1:22, repeat for more",
+		},
+		cli.StringFlag{
+			Name:  "tcplisten",
+			Value: "",
+			Usage: "listen address of the tcp transport, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "tlslisten",
+			Value: "",
+			Usage: "listen address of the tls transport, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "wslisten",
+			Value: "",
+			Usage: "listen address of the ws transport, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "wsslisten",
+			Value: "",
+			Usage: "listen address of the wss transport, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "wspath",
+			Value: "/",
+			Usage: "websocket path of the ws and wss transports",
+		},
+		cli.StringFlag{
+			Name:  "tlscert",
+			Value: "",
+			Usage: "pem certificate of the tls and wss transports",
+		},
+		cli.StringFlag{
+			Name:  "tlskey",
+			Value: "",
+			Usage: "pem private key of the tls and wss transports",
+		},
+		cli.StringFlag{
+			Name:  "ssudp",
+			Value: "",
+			Usage: "listen address of a stand-in shadowsocks udp server for testing the socks5 udp relay, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "ssmethod",
+			Value: "chacha20",
+			Usage: "cipher of the stand-in shadowsocks udp server",
+		},
+		cli.StringFlag{
+			Name:  "sspassword",
+			Value: "ODA5MzVjYj",
+			Usage: "password of the stand-in shadowsocks udp server",
+		},
+		cli.StringFlag{
+			Name:   "key",
+			Value:  "chenhongli",
+			Usage:  "pre-shared secret between client and server",
+			EnvVar: "KCPTUN_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:  "oldkey",
+			Usage: "older key still accepted during a key rotation, repeat for more",
+		},
+		cli.StringFlag{
+			Name:  "crypt",
+			Value: "salsa20",
+			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor,chacha20, none",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Value: "fast2",
+			Usage: "profiles: fast3, fast2, fast, normal",
+		},
+		cli.IntFlag{
+			Name:  "mtu",
+			Value: 1400,
+			Usage: "set maximum transmission unit for UDP packets",
+		},
+		cli.IntFlag{
+			Name:  "sndwnd",
+			Value: 2048,
+			Usage: "set send window size(num of packets)",
+		},
+		cli.IntFlag{
+			Name:  "rcvwnd",
+			Value: 256,
+			Usage: "set receive window size(num of packets)",
+		},
+		cli.IntFlag{
+			Name:  "datashard",
+			Value: 70,
+			Usage: "set reed-solomon erasure coding - datashard",
+		},
+		cli.IntFlag{
+			Name:  "parityshard",
+			Value: 30,
+			Usage: "set reed-solomon erasure coding - parityshard",
+		},
+		cli.BoolFlag{
+			Name:  "nocomp",
+			Usage: "disable compression",
+		},
+		cli.IntFlag{
+			Name:  "sockbuf",
+			Value: 4194304,
+			Usage: "socket buffer size in bytes",
+		},
+		cli.IntFlag{
+			Name:  "keepalive",
+			Value: 10,
+			Usage: "nat keepalive interval in seconds",
+		},
+		cli.IntFlag{
+			Name:  "framesize",
+			Value: 32768,
+			Usage: "smux max frame size in bytes",
+		},
+		cli.IntFlag{
+			Name:  "smuxkeepalive",
+			Value: 10,
+			Usage: "smux keepalive interval in seconds",
+		},
+		cli.IntFlag{
+			Name:  "smuxkeepalivetimeout",
+			Value: 30,
+			Usage: "close the smux session if nothing is received for this many seconds",
+		},
+		cli.StringFlag{
+			Name:  "c",
+			Value: "", // when the value is not empty, the config path must exists
+			Usage: "config from json file, which will override the command from shell",
+		},
+	}
+	myApp.Action = func(c *cli.Context) error {
+		config := serverConfig{}
+		config.Listen = c.String("listen")
+		config.Target = c.String("target")
+		for _, s := range c.StringSlice("map") {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 {
+				checkError(errors.Errorf("map %q is not like name=address", s))
+			}
+			if config.Targets == nil {
+				config.Targets = make(map[string]string)
+			}
+			config.Targets[kv[0]] = kv[1]
+		}
+		config.TCPListen = c.String("tcplisten")
+		config.TLSListen = c.String("tlslisten")
+		config.WSListen = c.String("wslisten")
+		config.WSSListen = c.String("wsslisten")
+		config.WSPath = c.String("wspath")
+		config.TLSCert = c.String("tlscert")
+		config.TLSKey = c.String("tlskey")
+		config.SSUDP = c.String("ssudp")
+		config.SSMethod = c.String("ssmethod")
+		config.SSPass = c.String("sspassword")
+		config.Key = c.String("key")
+		config.Crypt = c.String("crypt")
+		config.Mode = c.String("mode")
+		config.MTU = c.Int("mtu")
+		config.SndWnd = c.Int("sndwnd")
+		config.RcvWnd = c.Int("rcvwnd")
+		config.DataShard = c.Int("datashard")
+		config.ParityShard = c.Int("parityshard")
+		config.NoComp = c.Bool("nocomp")
+		config.SockBuf = c.Int("sockbuf")
+		config.KeepAlive = c.Int("keepalive")
+		config.FrameSize = c.Int("framesize")
+		config.SmuxKeepAlive = c.Int("smuxkeepalive")
+		config.SmuxKeepAliveTimeout = c.Int("smuxkeepalivetimeout")
+
+		if c.String("c") != "" {
+			file, err := os.Open(c.String("c"))
+			checkError(err)
+			err = json.NewDecoder(file).Decode(&config)
+			file.Close()
+			checkError(err)
+		}
+		mergeKeys(&config.Config, c.StringSlice("oldkey"))
+
+		checkError(applyMode(&config.Config))
+		block := newBlockCrypt(&config.Config)
+		smuxConfig, err := newSmuxConfig(&config.Config)
+		checkError(err)
+		handle := pipeTo(config.Target)
+		if len(config.Targets) > 0 {
+			// the clients send stream headers
+			handle = routeTo(config.Target, config.Targets)
+		}
+
+		log.Println("version:", VERSION)
+		log.Println("target:", config.Target)
+		for name, target := range config.Targets {
+			log.Println("mapped target:", name, target)
+		}
+		log.Println("encryption:", config.Crypt)
+		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+
+		if config.SSUDP != "" {
+			cipher, err := newCipher(config.SSMethod, config.SSPass)
+			checkError(err)
+			conn, err := net.ListenPacket("udp", config.SSUDP)
+			checkError(err)
+			log.Println("shadowsocks udp listening on:", conn.LocalAddr())
+			go serveShadowsocksUDP(conn, cipher)
+		}
+		if config.TCPListen != "" {
+			lis, err := net.Listen("tcp", config.TCPListen)
+			checkError(err)
+			log.Println("tcp listening on:", lis.Addr())
+			go serveStream(lis, &config.Config, smuxConfig, handle)
+		}
+		if config.TLSListen != "" {
+			cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+			checkError(err)
+			lis, err := tls.Listen("tcp", config.TLSListen, &tls.Config{Certificates: []tls.Certificate{cert}})
+			checkError(err)
+			log.Println("tls listening on:", lis.Addr())
+			go serveStream(lis, &config.Config, smuxConfig, handle)
+		}
+		if config.WSListen != "" {
+			lis, err := net.Listen("tcp", config.WSListen)
+			checkError(err)
+			log.Println("ws listening on:", lis.Addr(), "path:", config.WSPath)
+			go serveWebSocket(lis, config.WSPath, &config.Config, smuxConfig, handle)
+		}
+		if config.WSSListen != "" {
+			cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+			checkError(err)
+			lis, err := tls.Listen("tcp", config.WSSListen, &tls.Config{Certificates: []tls.Certificate{cert}})
+			checkError(err)
+			log.Println("wss listening on:", lis.Addr(), "path:", config.WSPath)
+			go serveWebSocket(lis, config.WSPath, &config.Config, smuxConfig, handle)
+		}
+
+		var lis *kcp.Listener
+		if len(config.Keys) > 0 {
+			config.Crypt = keyRing.reset(config.Crypt, config.Keys)
+			log.Println("keys:", len(config.Keys))
+			conn, err := net.ListenPacket("udp", config.Listen)
+			checkError(err)
+			lis, err = kcp.ServeConn(nil, config.DataShard, config.ParityShard, newKeyringConn(conn, &keyRing))
+			checkError(err)
+		} else {
+			lis, err = kcp.ListenWithOptions(config.Listen, block, config.DataShard, config.ParityShard)
+			checkError(err)
+		}
+		log.Println("kcp listening on:", lis.Addr())
+		serveKCP(lis, &config.Config, smuxConfig, handle)
+		return nil
+	}
+	myApp.Run(os.Args)
+}
@@ -6,7 +6,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
@@ -14,12 +13,10 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
+	"syscall"
 	"time"
 
-	"bytes"
-
-	gosocks5 "github.com/ginuerzh/gosocks5"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 	"github.com/yinghuocho/gotun2socks/core/packet"
 )
@@ -46,7 +43,9 @@ func init() {
 	rand.Seed(time.Now().Unix())
 }
 
-func handShake(conn net.Conn) (err error) {
+// handShake runs the socks5 method selection, the version byte ver has been
+// read already
+func handShake(conn net.Conn, ver byte) (err error) {
 	const (
 		idVer     = 0
 		idNmethod = 1
@@ -61,9 +60,11 @@ func handShake(conn net.Conn) (err error) {
 	var n int
 	ss.SetReadTimeout(conn)
 	// make sure we get the nmethod field
-	if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
+	buf[idVer] = ver
+	if n, err = io.ReadAtLeast(conn, buf[idNmethod:], 1); err != nil {
 		return
 	}
+	n++
 	if buf[idVer] != socksVer5 {
 		return errVer
 	}
@@ -78,8 +79,13 @@ func handShake(conn net.Conn) (err error) {
 	} else { // error, should not get extra data
 		return errAuthExtraData
 	}
-	// send confirmation: version 5, no authentication required
-	_, err = conn.Write([]byte{socksVer5, 0})
+	method, err := selectMethod(conn, buf[idNmethod+1:msgLen])
+	if err != nil {
+		return
+	}
+	if method == socksMethodPassword {
+		err = passwordAuth(conn)
+	}
 	return
 }
 
@@ -182,12 +188,33 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error, requestC
 
 type ServerCipher struct {
 	server string
-	cipher *ss.Cipher
+	cipher ssCipher
 }
 
 var servers struct {
 	srvCipher []*ServerCipher
-	failCnt   []int // failed connection count
+	failLock  sync.Mutex // the dials and the metrics page share failCnt
+	failCnt   []int      // failed connection count
+}
+
+const maxFailCnt = 30
+
+// failCount returns the recent failed connections to server i
+func failCount(i int) int {
+	servers.failLock.Lock()
+	defer servers.failLock.Unlock()
+	return servers.failCnt[i]
+}
+
+// countFailure notes a failed connection to server i, or a good one
+func countFailure(i int, failed bool) {
+	servers.failLock.Lock()
+	defer servers.failLock.Unlock()
+	if !failed {
+		servers.failCnt[i] = 0
+	} else if servers.failCnt[i] < maxFailCnt {
+		servers.failCnt[i]++
+	}
 }
 
 func parseServerConfig(config *ss.Config) {
@@ -201,11 +228,11 @@ func parseServerConfig(config *ss.Config) {
 
 	if len(config.ServerPassword) == 0 {
 		method := config.Method
-		if config.Auth {
+		if config.Auth && !isAEAD(method) {
 			method += "-auth"
 		}
 		// only one encryption table
-		cipher, err := ss.NewCipher(method, config.Password)
+		cipher, err := newCipher(method, config.Password)
 		if err != nil {
 			log.Fatal("Failed generating ciphers:", err)
 		}
@@ -227,7 +254,7 @@ func parseServerConfig(config *ss.Config) {
 		n := len(config.ServerPassword)
 		servers.srvCipher = make([]*ServerCipher, n)
 
-		cipherCache := make(map[string]*ss.Cipher)
+		cipherCache := make(map[string]ssCipher)
 		i := 0
 		for _, serverInfo := range config.ServerPassword {
 			if len(serverInfo) < 2 || len(serverInfo) > 3 {
@@ -248,7 +275,7 @@ func parseServerConfig(config *ss.Config) {
 			cipher, ok := cipherCache[cacheKey]
 			if !ok {
 				var err error
-				cipher, err = ss.NewCipher(encmethod, passwd)
+				cipher, err = newCipher(encmethod, passwd)
 				if err != nil {
 					log.Fatal("Failed generating ciphers:", err)
 				}
@@ -258,29 +285,30 @@ func parseServerConfig(config *ss.Config) {
 			i++
 		}
 	}
+	servers.failLock.Lock()
 	servers.failCnt = make([]int, len(servers.srvCipher))
+	servers.failLock.Unlock()
 	for _, se := range servers.srvCipher {
 		log.Println("available remote server", se.server)
 	}
 	return
 }
 
-func connectToServer(serverId int, rawaddr []byte, addr string) (remote *ss.Conn, err error) {
+func connectToServer(serverId int, rawaddr []byte, addr string) (remote net.Conn, err error) {
 	se := servers.srvCipher[serverId]
 	log.Println("se.server:", se.server, ";rawaddr:", string(rawaddr))
 	log.Println("before connectToServer")
-	remote, err = ss.DialWithRawAddr(rawaddr, se.server, se.cipher.Copy())
+	start := time.Now()
+	remote, err = se.cipher.dial(rawaddr, se.server)
 	log.Println("after connectToServer")
 	if err != nil {
 		log.Println("error connecting to shadowsocks server:", err)
-		const maxFailCnt = 30
-		if servers.failCnt[serverId] < maxFailCnt {
-			servers.failCnt[serverId]++
-		}
+		countFailure(serverId, true)
 		return nil, err
 	}
 	//	debug.Printf("connected to %s via %s\n", addr, se.server)
-	servers.failCnt[serverId] = 0
+	connectLatency.observe(labels("component", "shadowsocks", "server", se.server), time.Since(start).Seconds())
+	countFailure(serverId, false)
 	return
 }
 
@@ -288,13 +316,13 @@ func connectToServer(serverId int, rawaddr []byte, addr string) (remote *ss.Conn
 // connection failure, try the next server. A failed server will be tried with
 // some probability according to its fail count, so we can discover recovered
 // servers.
-func createServerConn(rawaddr []byte, addr string) (remote *ss.Conn, err error) {
+func createServerConn(rawaddr []byte, addr string) (remote net.Conn, err error) {
 	const baseFailCnt = 20
 	n := len(servers.srvCipher)
 	skipped := make([]int, 0)
 	for i := 0; i < n; i++ {
 		// skip failed server, but try it with some probability
-		if servers.failCnt[i] > 0 && rand.Intn(servers.failCnt[i]+baseFailCnt) != 0 {
+		if n := failCount(i); n > 0 && rand.Intn(n+baseFailCnt) != 0 {
 			skipped = append(skipped, i)
 			continue
 		}
@@ -324,8 +352,24 @@ func handleConnection(conn net.Conn) {
 		}
 	}()
 
+	// the first byte tells socks4, socks5 and http apart
+	ver := make([]byte, 1)
+	ss.SetReadTimeout(conn)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return
+	}
+	switch ver[0] {
+	case socksVer4:
+		handleSocks4(conn)
+		return
+	case socksVer5:
+	default:
+		handleHTTP(conn, ver[0])
+		return
+	}
+
 	var err error = nil
-	if err = handShake(conn); err != nil {
+	if err = handShake(conn, ver[0]); err != nil {
 		log.Println("socks handshake:", err)
 		return
 	}
@@ -345,33 +389,65 @@ func handleConnection(conn net.Conn) {
 	*/
 	if requestCmd == 1 {
 		doConnectSocket(conn, rawaddr, addr, closed)
+	} else if requestCmd == 2 {
+		conn.SetDeadline(time.Time{})
+		doBindSocket(conn, addr)
 	} else if requestCmd == 3 {
 		doUdpSocket(conn, rawaddr, addr, closed)
 	}
 
 }
 
-func errorReplySocks5(reason byte) []byte {
-	return []byte{0x05, reason, 0x00, 0x01,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-}
+// socks5 reply codes, RFC 1928 section 6
+const (
+	socksRepSucceeded       = 0x00
+	socksRepFailure         = 0x01
+	socksRepNetUnreachable  = 0x03
+	socksRepHostUnreachable = 0x04
+	socksRepRefused         = 0x05
+	socksRepTTLExpired      = 0x06
+)
 
-type replayUDPst struct {
-	udpAddr *net.UDPAddr
-	header  []byte
-}
+// socks5 address types
+const (
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+)
 
-type SockAddr struct {
-	Host string
-	Port int
+// socksStrict makes CONNECT dial before replying, so the reply carries the
+// outcome of the dial and the bound address
+var socksStrict bool
+
+// socksReplyCode maps a dial error to a reply code, the error may come
+// wrapped in a *net.OpError or in errors of the cipher
+func socksReplyCode(err error) byte {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return socksRepTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socksRepHostUnreachable
+	}
+	var oe *net.OpError
+	var errno syscall.Errno
+	if errors.As(err, &oe) && errors.As(oe.Err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return socksRepRefused
+		case syscall.ENETUNREACH:
+			return socksRepNetUnreachable
+		case syscall.EHOSTUNREACH:
+			return socksRepHostUnreachable
+		}
+	}
+	return socksRepFailure
 }
 
-func (addr *SockAddr) ByteArray() []byte {
-	bytes := make([]byte, 6)
-	copy(bytes[:4], net.ParseIP(addr.Host).To4())
-	bytes[4] = byte(addr.Port >> 8)
-	bytes[5] = byte(addr.Port % 256)
-	return bytes
+func errorReplySocks5(reason byte) []byte {
+	return []byte{0x05, reason, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 }
 
 //func relayCheck(remoteIP net.IP) bool {
@@ -390,51 +466,6 @@ func (addr *SockAddr) ByteArray() []byte {
 //	return relayMap.m[relayServer]
 //}
 
-func doUdpSocket(conn net.Conn, rawaddr []byte, addr string, closed bool) {
-	log.Println("start udp socket")
-	//负责读取本地与远程过来的数据，只负责replay远程
-	UDPConn, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		log.Printf("failed to ListenUDP: %v\n", err)
-		conn.Write(errorReplySocks5(0x01)) // general SOCKS server failure
-		return
-	}
-	//只负责replay本地
-	udpConnToClient, err := net.ListenUDP("udp", nil)
-	if err != nil {
-		log.Printf("failed to ListenUDP: %v\n", err)
-		conn.Write(errorReplySocks5(0x01)) // general SOCKS server failure
-		return
-	}
-	ssConn := ss.NewSecurePacketConn(UDPConn, servers.srvCipher[0].cipher.Copy(), true) // force OTA on
-	defer UDPConn.Close()
-	defer udpConnToClient.Close()
-	// RelayCheck
-	remoteIP := conn.RemoteAddr().(*net.TCPAddr).IP
-	log.Println("remoteIP:", remoteIP)
-	//	host := conn.LocalAddr().(*net.TCPAddr).IP.String()
-	host := remoteIP
-	port := UDPConn.LocalAddr().(*net.UDPAddr).Port
-	localaddr := SockAddr{host.String(), port}
-	// reply command
-	buf := make([]byte, 10)
-	copy(buf, []byte{0x05, 0x00, 0x00, 0x01})
-	copy(buf[4:], localaddr.ByteArray())
-	conn.Write(buf)
-	conn.(*net.TCPConn).SetKeepAlive(true)
-	conn.(*net.TCPConn).SetKeepAlivePeriod(15 * time.Second)
-
-	conn.SetDeadline(time.Time{})
-	coneMap := make(map[string]*replayUDPst, 128)
-
-	file, _ := UDPConn.File()
-	SendMsg(strconv.Itoa(int(file.Fd())))
-
-	time.Sleep(2 * time.Second)
-	go handleUDP(conn, UDPConn, ssConn, udpConnToClient, coneMap)
-	io.Copy(ioutil.Discard, conn)
-}
-
 func isUseOfClosedConn(err error) bool {
 	operr, ok := err.(*net.OpError)
 	return ok && operr.Err.Error() == "use of closed network connection"
@@ -442,6 +473,9 @@ func isUseOfClosedConn(err error) bool {
 
 var blockdomain []string
 
+// udpNetem impairs the udp relay for testing, see parseNetem
+var udpNetem *netemConfig
+
 func isBlockDomain(domain string) bool {
 	for i := 0; i < len(blockdomain); i++ {
 		if strings.HasSuffix(domain, blockdomain[i]) {
@@ -451,179 +485,6 @@ func isBlockDomain(domain string) bool {
 	return false
 }
 
-const MAX_UDPBUF = 4096
-const (
-	idType  = 0 // address type index
-	idIP0   = 1 // ip addres start index
-	idDmLen = 1 // domain address length index
-	idDm0   = 2 // domain address start index
-
-	typeIPv4 = 1 // type is ipv4 address
-	typeDm   = 3 // type is domain address
-	typeIPv6 = 4 // type is ipv6 address
-
-	lenIPv4     = 1 + net.IPv4len + 2 // 1addrType + ipv4 + 2port
-	lenIPv6     = 1 + net.IPv6len + 2 // 1addrType + ipv6 + 2port
-	lenDmBase   = 1 + 1 + 2           // 1addrType + 1addrLen + 2port, plus addrLen
-	lenHmacSha1 = 10
-)
-
-//Port Restricted Cone(NAT)
-/**
-有数据包时，首先将数据全部读取，然后判断数据是从客户端还是远程目标传送过来的(在读取时可以得到是从什么地址和端口读取到数据的，然后比较上面第6步时我们保存了下来的客户端的连接信息)，
-如果数据是从客户端读取过来的,我们要将UDP头去掉.例如我们读取到的Buffer,Buffer[3]是1时，UDP头就是10个字节长度,如果Buffer[3]是3的话,UDP头长度是7+Buffer[4].
-例如我们得到UDP头是20位，我们接收到的Buffer是50位长度，那么我们发送到目标的数据包长度是30位，前20位不发送，只发送后面的30位.
-如果数据是从远程目标发送来的,我们就要多发送多10位的UDP头,这10位的UDP头前三位都是0,第四位是0x01,第五到第八位是我们保存下来的客户端的IP,第9和第十位是客户端的端口.
-如果我们接收到的Buffer长度是50,那么我们发送到客户端的数据就要加上10位的UDP头，也就是一共要发送60位字节长度的数据.
-*/
-func handleUDP(conn net.Conn, UDPConn *net.UDPConn, ssConn *ss.SecurePacketConn, udpConnToClient *net.UDPConn, coneMap map[string]*replayUDPst) {
-	defer conn.Close()
-	log.Println("start handle udp")
-	var Transfer int64 //protect by sync/atomic
-
-	for {
-		buf := make([]byte, MAX_UDPBUF)
-		UDPConn.SetReadDeadline(time.Now().Add(1 * time.Minute))
-		n, udpAddr, err := UDPConn.ReadFromUDP(buf)
-		if err != nil {
-			if !isUseOfClosedConn(err) {
-				//				log.Printf("[%s]fail read client udp: %v\n", s5.User, err)
-				log.Printf("[%s]fail read client udp: %v\n", err)
-			}
-			return
-		}
-		buf = buf[:n]
-		log.Println("receive:", string(buf[:]))
-		log.Println("udpAddr.String():", udpAddr.String())
-		//		rus := s5.getConeMap(udpAddr.String())
-		rus := coneMap[udpAddr.String()]
-
-		//		cipher := ssConn.Copy()
-		//		iv := make([]byte, ssConn.GetIvLen())
-		//		copy(iv, buf[:ssConn.GetIvLen()])
-		//		if err = cipher.InitDecrypt(iv); err == nil {
-		//		if rus != nil {
-		if udpAddr.IP.String() != "127.0.0.1" {
-			//收到的数据为加密数据
-			//			return
-			//		}
-			//		if rus != nil {
-			// reply udp data to client
-			// log.Printf("[%s]%s reply udp data to client:[%q]\n", s5.User, udpAddr, buf)
-			paraseResult, n := ssConn.ParseReadData(buf)
-
-			reqLen := lenIPv4
-			dstIP := net.IP(paraseResult[idIP0 : idIP0+net.IPv4len])
-			dst := &net.UDPAddr{
-				IP:   dstIP,
-				Port: int(binary.BigEndian.Uint16(paraseResult[reqLen-2 : reqLen])),
-			}
-			//			log.Println("is to client", len(rus.header), ";paraseResult:", len(paraseResult), ";n:", n)
-			log.Println("is to client", ";paraseResult:", len(paraseResult), ";n:", n, ";dstIP:", dstIP.String(), ";port:", dst)
-
-			rus = coneMap[dst.String()]
-			if rus != nil {
-				log.Println("rus is not null,rus.udpAddr:", rus.udpAddr.String())
-			}
-			//			sendToClient := &net.UDPAddr{
-			//				IP:   rus.udpAddr.IP,
-			//				Port: rus.udpAddr.Port,
-			//			}
-			sendData := paraseResult[reqLen:n]
-			log.Println("send to client data:", string(sendData[:]))
-
-			log.Println("is to client", len(rus.header), ";")
-			data := make([]byte, 0, len(rus.header)+len(sendData))
-			data = append(data, rus.header...)
-			data = append(data, sendData...)
-			//			n, err := UDPConn.WriteToUDP(data, rus.udpAddr)
-			log.Println("写入到本地udp，写入服务地址:", udpConnToClient.LocalAddr().String())
-			n, err := udpConnToClient.WriteTo(data, rus.udpAddr)
-			if err != nil {
-				log.Println("发送数据失败：", err.Error())
-			}
-			log.Println("write to client end,n:", n)
-			//			upTransferUdp(int64(len(buf)), udpAddr.String())
-			atomic.AddInt64(&Transfer, int64(n))
-		} else {
-			//send udp data to server
-			if buf[0] != 0x00 || buf[1] != 0x00 || buf[2] != 0x00 {
-				continue // RSV,RSV,FRAG
-			}
-			udpHeader := make([]byte, 0, 10)
-			addrtype := buf[3]
-			var remote string
-			var udpData []byte
-			if addrtype == 0x01 { // 0x01: IP V4 address
-				ip := net.IPv4(buf[4], buf[5], buf[6], buf[7])
-				if !ip.IsGlobalUnicast() {
-					continue
-				}
-				remote = fmt.Sprintf("%s:%d", ip.String(), int(buf[8])<<8+int(buf[9]))
-				udpData = buf[10:]
-				udpHeader = append(udpHeader, buf[:10]...)
-			} else if addrtype == 0x03 { // 0x03: DOMAINNAME
-				nmlen := int(buf[4]) // domain name length
-				nmbuf := buf[5 : 5+nmlen+2]
-				if isBlockDomain(string(nmbuf[:nmlen])) {
-					continue
-				}
-				remote = fmt.Sprintf("%s:%d", nmbuf[:nmlen], int(nmbuf[nmlen])<<8+int(nmbuf[nmlen+1]))
-				udpData = buf[8+nmlen:]
-				udpHeader = append(udpHeader, buf[:8+nmlen]...)
-			} else {
-				continue // address type not supported
-			}
-			log.Println("udp remoteIP:", remote, ";proxy address:", servers.srvCipher[0].server)
-			//			remote = "127.0.0.1:12948"
-			//			remote = "192.168.0.47:434"
-			remoteAddr, err := net.ResolveUDPAddr("udp", remote)
-			if err != nil {
-				//				log.Printf("[%s]fail resolve dns: %v\n", s5.User, err)
-				log.Printf("[%s]fail resolve dns: %v\n", err)
-				continue
-			}
-			log.Println("走kcp：", servers.srvCipher[0].server)
-			//			dstAddr, err := net.ResolveUDPAddr("udp", servers.srvCipher[0].server)
-			dstAddr, err := net.ResolveUDPAddr("udp", "192.168.0.47:434") //此处暂时未走kcp
-			if err != nil {
-				//				log.Printf("[%s]fail resolve dns: %v\n", s5.User, err)
-				log.Printf("[%s]fail resolve dns: %v\n", err)
-				continue
-			}
-			//log.Printf("[%s]send udp package to %s:[%q]\n", s5.User, remote, udpData)
-			//			s5.addConeMap(&replayUDPst{udpAddr, udpHeader}, remoteAddr.String())
-			//			udpAddr.IP = []byte("10.0.2.2")
-			coneMap[remoteAddr.String()] = &replayUDPst{udpAddr, udpHeader}
-			//			n, _ := UDPConn.WriteToUDP(udpData, remoteAddr)
-			log.Println("before send to server:", string(udpData[:]))
-			dgram := gosocks5.NewUDPDatagram(gosocks5.NewUDPHeader(0, 0, ToSocksAddr(remoteAddr)), udpData)
-			b := bytes.Buffer{}
-			dgram.Write(&b)
-
-			n, _ := ssConn.WriteTo(b.Bytes()[3:], dstAddr)
-			log.Println("after write udp")
-
-			//			s5.upTransferUdp(int64(n), udpAddr.String())
-			atomic.AddInt64(&Transfer, int64(n))
-		}
-	}
-}
-func ToSocksAddr(addr net.Addr) *gosocks5.Addr {
-	host := "0.0.0.0"
-	port := 0
-	if addr != nil {
-		h, p, _ := net.SplitHostPort(addr.String())
-		host = h
-		port, _ = strconv.Atoi(p)
-	}
-	return &gosocks5.Addr{
-		Type: gosocks5.AddrIPv4,
-		Host: host,
-		Port: uint16(port),
-	}
-}
-
 //func upTransferUdp(sum int64, udpAddr string) {
 //	atomic.AddInt64(&Transfer, sum)
 //	//	if s5.Info.logEnable {
@@ -636,6 +497,10 @@ func ToSocksAddr(addr net.Addr) *gosocks5.Addr {
 //}
 
 func doConnectSocket(conn net.Conn, rawaddr []byte, addr string, closed bool) {
+	if socksStrict {
+		doStrictConnect(conn, rawaddr, addr)
+		return
+	}
 	// Sending connection established message immediately to client.
 	// This some round trip time for creating socks connection with the client.
 	// But if connection failed, the client will get connection reset error.
@@ -667,25 +532,46 @@ func doConnectSocket(conn net.Conn, rawaddr []byte, addr string, closed bool) {
 	debug.Println("closed connection to", addr)
 }
 
+// doStrictConnect dials the shadowsocks server before replying. The reply
+// reflects that dial, the shadowsocks protocol tells nothing about the
+// server's own connection to addr.
+func doStrictConnect(conn net.Conn, rawaddr []byte, addr string) {
+	remote, err := createServerConn(rawaddr, addr)
+	if err != nil {
+		rep := socksReplyCode(err)
+		log.Println("socks connect:", addr, err, "reply:", rep)
+		conn.Write(socksReply(rep, nil))
+		return
+	}
+	defer remote.Close()
+	if _, err := conn.Write(socksReply(socksRepSucceeded, remote.LocalAddr())); err != nil {
+		debug.Println("send connection confirmation:", err)
+		return
+	}
+	go ss.PipeThenClose(conn, remote)
+	ss.PipeThenClose(remote, conn)
+	debug.Println("closed connection to", addr)
+}
+
 var shadowFd int
 
 func GetShadowFd() int {
 	return shadowFd
 }
 
-func run(listenAddr string) {
-	ln, err := net.Listen("tcp", listenAddr)
+func run(listenAddr, mode, owner string, filter *addrFilter, acceptProxy bool) {
+	ln, err := listenLocal(listenAddr, mode, owner)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("starting local socks5 server at %v ...\n", listenAddr)
+	log.Printf("starting local socks and http proxy server at %v ...\n", listenAddr)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Println("accept:", err)
 			continue
 		}
-		go handleConnection(conn)
+		filter.serveAccepted(conn, "socks5", acceptProxy, handleConnection)
 	}
 }
 
@@ -700,21 +586,38 @@ func StartShadowSocks() {
 	var configFile, cmdServer, cmdLocal string
 	var cmdConfig ss.Config
 	var printVer bool
+	var metricsAddr string
+	var netemSpec string
+	var socketMode, socketOwner string
+	var allow, deny, proxies string
+	var socksUsersFile string
+	var acceptProxy bool
 
 	flag.BoolVar(&printVer, "version", false, "print version")
 	flag.StringVar(&configFile, "c", "config.json", "specify config file")
 	flag.StringVar(&cmdServer, "s", "127.0.0.1", "server address")
 	//	flag.StringVar(&cmdServer, "s", "192.168.0.47", "server address")
-	flag.StringVar(&cmdLocal, "b", "", "local address, listen only to this address if specified")
+	flag.StringVar(&cmdLocal, "b", "", "local address, listen only to this address if specified, unix:/path for a unix socket")
 	flag.StringVar(&cmdConfig.Password, "k", "ODA5MzVjYj", "password")
 	flag.IntVar(&cmdConfig.ServerPort, "p", 12948, "server port")
 	//	flag.IntVar(&cmdConfig.ServerPort, "p", 434, "server port")
 	flag.IntVar(&cmdConfig.Timeout, "t", 300, "timeout in seconds")
-	flag.IntVar(&cmdConfig.LocalPort, "l", 1080, "local socks5 proxy port")
+	flag.IntVar(&cmdConfig.LocalPort, "l", 1080, "local socks4, socks5 and http proxy port")
 	flag.StringVar(&cmdConfig.Method, "m", "chacha20", "encryption method, default: aes-256-cfb")
 	flag.BoolVar((*bool)(&debug), "d", true, "print debug message")
 	flag.BoolVar(&cmdConfig.Auth, "A", false, "one time auth")
 	flag.BoolVar(&cmdConfig.UDP, "U", true, "是否支持udp")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve prometheus metrics at http://<addr>/metrics")
+	flag.StringVar(&socketMode, "socketmode", "", "octal file mode of a unix socket listener, like: 0660")
+	flag.StringVar(&socketOwner, "socketowner", "", "user[:group] owning a unix socket listener")
+	flag.StringVar(&socksUsersFile, "socksusers", "", "json file with the socks_users of socks5 authentication, default to the config file")
+	flag.StringVar(&allow, "allow", "", "comma separated CIDRs or addresses allowed to use the socks5 listener")
+	flag.StringVar(&deny, "deny", "", "comma separated CIDRs or addresses refused by the socks5 listener")
+	flag.StringVar(&udpServer, "udpserver", "", "shadowsocks server of the udp relay, default to the tcp server")
+	flag.BoolVar(&socksStrict, "strict", false, "dial before answering socks5 CONNECT and reply with the real outcome and bound address")
+	flag.BoolVar(&acceptProxy, "acceptproxy", false, "require a PROXY protocol v1 or v2 header from a load balancer on each socks5 connection")
+	flag.StringVar(&proxies, "proxies", "", "comma separated CIDRs or addresses of the load balancers trusted with PROXY headers, default to any peer allow and deny admit")
+	flag.StringVar(&netemSpec, "netem", "", "impair the udp relay for testing, like: loss=10%,latency=50ms")
 
 	flag.Parse()
 
@@ -724,6 +627,12 @@ func StartShadowSocks() {
 	}
 
 	cmdConfig.Server = cmdServer
+	impair, err := parseNetem(netemSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	udpNetem = impair
 	ss.SetDebug(debug)
 
 	if strings.HasSuffix(cmdConfig.Method, "-auth") {
@@ -750,6 +659,20 @@ func StartShadowSocks() {
 		}
 	} else {
 		ss.UpdateConfig(config, &cmdConfig)
+		if socksUsersFile == "" {
+			socksUsersFile = configFile
+		}
+	}
+	if socksUsersFile != "" {
+		users, err := parseSocksUsers(socksUsersFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading socks_users from %s: %v\n", socksUsersFile, err)
+			os.Exit(1)
+		}
+		socksUsers = users
+		if len(socksUsers) > 0 {
+			log.Println("socks5 authentication:", len(socksUsers), "users")
+		}
 	}
 	if config.Method == "" {
 		config.Method = "aes-256-cfb"
@@ -770,6 +693,17 @@ func StartShadowSocks() {
 	}
 
 	parseServerConfig(config)
+	serveMetrics(metricsAddr)
 
-	run(cmdLocal + ":" + strconv.Itoa(config.LocalPort))
+	listenAddr := cmdLocal + ":" + strconv.Itoa(config.LocalPort)
+	if isUnixAddr(cmdLocal) {
+		listenAddr = cmdLocal
+	}
+	setSocksUpstream(listenAddr)
+	filter, err := newAddrFilter(strings.Split(allow, ","), strings.Split(deny, ","), strings.Split(proxies, ","))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	run(listenAddr, socketMode, socketOwner, filter, acceptProxy)
 }
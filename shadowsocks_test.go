@@ -0,0 +1,81 @@
+package kcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want byte
+	}{
+		{dialError(syscall.ECONNREFUSED), socksRepRefused},
+		{dialError(syscall.ENETUNREACH), socksRepNetUnreachable},
+		{dialError(syscall.EHOSTUNREACH), socksRepHostUnreachable},
+		{fmt.Errorf("shadowsocks server: %w", dialError(syscall.ECONNREFUSED)), socksRepRefused},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, socksRepTTLExpired},
+		{fmt.Errorf("dial: %w", timeoutError{}), socksRepTTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, socksRepHostUnreachable},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}, socksRepHostUnreachable},
+		{syscall.ECONNREFUSED, socksRepFailure},
+		{errors.New("cipher"), socksRepFailure},
+	} {
+		if got := socksReplyCode(c.err); got != c.want {
+			t.Errorf("socksReplyCode(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+// socks5Connect runs a socks5 CONNECT to addr on the mixed listener and
+// returns the connection and the reply
+func socks5Connect(t *testing.T, mixed string, addr *net.TCPAddr) (net.Conn, []byte) {
+	conn := dialMixed(t, mixed)
+	conn.Write([]byte{socksVer5, 1, socksMethodNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	ip := addr.IP.To4()
+	conn.Write(append([]byte{socksVer5, 1, 0, socksAtypIPv4, ip[0], ip[1], ip[2], ip[3]}, byte(addr.Port>>8), byte(addr.Port)))
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply
+}
+
+func TestStrictConnect(t *testing.T) {
+	withDirectServer(t)
+	withSocksUsers(t, nil)
+	socksStrict = true
+	defer func() { socksStrict = false }()
+	mixed := mixedListener(t)
+
+	echo := tcpEchoServer(t)
+	conn, reply := socks5Connect(t, mixed, echo)
+	if reply[1] != socksRepSucceeded || reply[3] != socksAtypIPv4 || reply[8]|reply[9] == 0 {
+		t.Errorf("reply %v, want success with the bound address", reply)
+	}
+	expectEcho(t, conn, conn)
+
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	if _, reply := socks5Connect(t, mixed, closed); reply[1] != socksRepRefused {
+		t.Errorf("reply %v, want connection refused", reply)
+	}
+}
@@ -0,0 +1,52 @@
+package kcp
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// snmpLogger appends kcp.DefaultSnmp to a csv file every interval seconds.
+// The file name part of path is a time.Format layout, e.g.
+// ./snmp-20060102.log starts a new file every day. Counters are cumulative
+// since start, a header is written to every new file. A failed write is
+// logged and tried again on the next tick.
+func snmpLogger(path string, interval int) {
+	if path == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := appendSnmp(path, now); err != nil {
+			log.Println("snmplog:", err)
+		}
+	}
+}
+
+// appendSnmp appends a row of kcp.DefaultSnmp to the file path names at now
+func appendSnmp(path string, now time.Time) error {
+	// only the file name is formatted, so the layout can't mess up the directory
+	logdir, logfile := filepath.Split(path)
+	f, err := os.OpenFile(logdir+now.Format(logfile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
+		if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
+			return err
+		}
+	}
+	if err := w.Write(append([]string{fmt.Sprint(now.Unix())}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
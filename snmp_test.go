@@ -0,0 +1,65 @@
+package kcp
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAppendSnmp(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snmp-20060102.log")
+	day := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if err := appendSnmp(path, day.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appendSnmp(path, day.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "snmp-20200102.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "Unix" {
+		t.Fatalf("rows = %q, want a header and two rows", rows)
+	}
+	if rows[1][0] != strconv.FormatInt(day.Unix(), 10) {
+		t.Errorf("first row at %s", rows[1][0])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "snmp-20200103.log")); err != nil {
+		t.Errorf("no new file for the next day: %v", err)
+	}
+}
+
+func TestAppendSnmpMissingDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "snmp.log")
+	if err := appendSnmp(path, time.Now()); err == nil {
+		t.Error("appendSnmp() into a missing directory: no error")
+	}
+}
+
+func TestSnmpLoggerBadInterval(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		snmpLogger(filepath.Join(t.TempDir(), "snmp.log"), -1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("snmpLogger() with a negative interval kept running")
+	}
+}
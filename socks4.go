@@ -0,0 +1,113 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+// SOCKS4 and SOCKS4a CONNECT on the socks5 listener, forwarded through the
+// shadowsocks servers like socks5 CONNECT.
+
+const (
+	socksVer4          = 4
+	socks4CmdConnect   = 1
+	socks4Granted      = 90
+	socks4Rejected     = 91
+	socks4MaxFieldSize = 255
+)
+
+var errSocks4Field = errors.New("socks4 user id or host name too long")
+
+// readNullString reads a null terminated field of the request a byte at a
+// time, so nothing the client sends after it gets lost in a buffer
+func readNullString(r io.Reader) (string, error) {
+	var b []byte
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(b), nil
+		}
+		if len(b) == socks4MaxFieldSize {
+			return "", errSocks4Field
+		}
+		b = append(b, c[0])
+	}
+}
+
+// socks4Request reads a request after the version byte and returns the
+// command with the target as a socks5 raw address and as host:port
+func socks4Request(conn net.Conn) (cmd byte, rawaddr []byte, addr string, err error) {
+	head := make([]byte, 7) // cmd, port, ip
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return
+	}
+	cmd = head[0]
+	port := head[1:3]
+	ip := net.IP(head[3:7])
+	if _, err = readNullString(conn); err != nil { // user id
+		return
+	}
+
+	// 4a: 0.0.0.x with x != 0 means a host name follows
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var host string
+		if host, err = readNullString(conn); err != nil {
+			return
+		}
+		rawaddr = append([]byte{socksAtypDomain, byte(len(host))}, host...)
+		addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	} else {
+		rawaddr = append([]byte{socksAtypIPv4}, ip...)
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	}
+	rawaddr = append(rawaddr, port...)
+	return
+}
+
+func socks4Reply(rep byte) []byte {
+	return []byte{0, rep, 0, 0, 0, 0, 0, 0}
+}
+
+// handleSocks4 serves a socks4 or socks4a client whose version byte has been
+// read, only CONNECT is supported
+func handleSocks4(conn net.Conn) {
+	cmd, rawaddr, addr, err := socks4Request(conn)
+	if err != nil {
+		log.Println("socks4 request:", err)
+		return
+	}
+	if len(socksUsers) > 0 {
+		// socks4 has no passwords
+		log.Println("socks4: refused", conn.RemoteAddr(), "authentication is required")
+		conn.Write(socks4Reply(socks4Rejected))
+		return
+	}
+	if cmd != socks4CmdConnect {
+		log.Println("socks4: command not supported:", cmd)
+		conn.Write(socks4Reply(socks4Rejected))
+		return
+	}
+
+	remote, err := createServerConn(rawaddr, addr)
+	if err != nil {
+		log.Println("socks4:", addr, err)
+		conn.Write(socks4Reply(socks4Rejected))
+		return
+	}
+	defer remote.Close()
+	if _, err := conn.Write(socks4Reply(socks4Granted)); err != nil {
+		return
+	}
+	go ss.PipeThenClose(conn, remote)
+	ss.PipeThenClose(remote, conn)
+	debug.Println("closed connection to", addr)
+}
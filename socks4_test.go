@@ -0,0 +1,68 @@
+package kcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocks4Request(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		req     []byte
+		rawaddr []byte
+		addr    string
+	}{
+		{"socks4", []byte{1, 0, 80, 192, 0, 2, 1, 'u', 0}, []byte{socksAtypIPv4, 192, 0, 2, 1, 0, 80}, "192.0.2.1:80"},
+		{"socks4a", []byte{1, 1, 187, 0, 0, 0, 1, 0, 'e', 'x', '.', 'o', 'r', 'g', 0}, []byte{socksAtypDomain, 6, 'e', 'x', '.', 'o', 'r', 'g', 1, 187}, "ex.org:443"},
+	} {
+		cmd, rawaddr, addr, err := socks4Request(headerConn(t, append(c.req, "rest"...)))
+		if err != nil || cmd != socks4CmdConnect || !bytes.Equal(rawaddr, c.rawaddr) || addr != c.addr {
+			t.Errorf("%s: socks4Request() = %d, %v, %q, %v", c.name, cmd, rawaddr, addr, err)
+		}
+	}
+}
+
+func TestSocks4RequestInvalid(t *testing.T) {
+	long := append([]byte{1, 0, 80, 192, 0, 2, 1}, strings.Repeat("u", socks4MaxFieldSize+1)...)
+	if _, _, _, err := socks4Request(headerConn(t, append(long, 0))); err != errSocks4Field {
+		t.Errorf("long user id: %v", err)
+	}
+	if _, _, _, err := socks4Request(headerConn(t, []byte{1, 0, 80, 192, 0, 2, 1, 'u'})); err == nil {
+		t.Error("unterminated user id: no error")
+	}
+	if _, _, _, err := socks4Request(headerConn(t, []byte{1, 0, 80, 0, 0, 0, 1, 0, 'e', 'x'})); err == nil {
+		t.Error("unterminated host name: no error")
+	}
+}
+
+// socks4Exchange sends req to handleSocks4 and returns its reply
+func socks4Exchange(t *testing.T, req []byte) []byte {
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		handleSocks4(server)
+		server.Close()
+	}()
+	go client.Write(req)
+	reply, _ := ioutil.ReadAll(client)
+	return reply
+}
+
+func TestSocks4Refused(t *testing.T) {
+	withSocksUsers(t, nil)
+	bind := []byte{2, 0, 80, 192, 0, 2, 1, 0}
+	if reply := socks4Exchange(t, bind); !bytes.Equal(reply, socks4Reply(socks4Rejected)) {
+		t.Errorf("BIND: reply %v", reply)
+	}
+
+	withSocksUsers(t, map[string]string{"alice": "secret"})
+	connect := []byte{1, 0, 80, 192, 0, 2, 1, 'a', 'l', 'i', 'c', 'e', 0}
+	if reply := socks4Exchange(t, connect); !bytes.Equal(reply, socks4Reply(socks4Rejected)) {
+		t.Errorf("with socks users: reply %v", reply)
+	}
+}
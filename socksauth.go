@@ -0,0 +1,114 @@
+package kcp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+// SOCKS5 username/password authentication, RFC 1929. The users live in the
+// shadowsocks config file next to the server settings, or in a file of their
+// own given with -socksusers:
+//
+//	"socks_users": {"alice": "secret"}
+
+const (
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+	socksNoAcceptable   = 0xff
+	socksAuthVer        = 0x01
+	socksAuthSuccess    = 0x00
+	socksAuthFailure    = 0x01
+)
+
+var (
+	errNoMethod = errors.New("socks no acceptable authentication method")
+	errAuthVer  = errors.New("socks username/password version not supported")
+	errAuth     = errors.New("socks authentication failed")
+)
+
+// socksUsers maps user names to passwords, empty means no authentication
+var socksUsers map[string]string
+
+// socksCredential returns the user the http proxy signs in to our own
+// socks listener as, the first name so that it is the same every time
+func socksCredential() (user, passwd string, ok bool) {
+	for name := range socksUsers {
+		if !ok || name < user {
+			user, ok = name, true
+		}
+	}
+	return user, socksUsers[user], ok
+}
+
+// parseSocksUsers reads the socks_users of a shadowsocks config file
+func parseSocksUsers(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var config struct {
+		SocksUsers map[string]string `json:"socks_users"`
+	}
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, err
+	}
+	return config.SocksUsers, nil
+}
+
+// selectMethod answers the methods a client offers, password when there are
+// users and none otherwise
+func selectMethod(conn net.Conn, methods []byte) (byte, error) {
+	want := byte(socksMethodNone)
+	if len(socksUsers) > 0 {
+		want = socksMethodPassword
+	}
+	for _, m := range methods {
+		if m == want {
+			_, err := conn.Write([]byte{socksVer5, want})
+			return want, err
+		}
+	}
+	conn.Write([]byte{socksVer5, socksNoAcceptable})
+	return socksNoAcceptable, errNoMethod
+}
+
+// passwordAuth runs the username/password subnegotiation
+func passwordAuth(conn net.Conn) error {
+	// ver, ulen, uname (1-255), plen, passwd (1-255)
+	buf := make([]byte, 2+255+1+255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksAuthVer {
+		return errAuthVer
+	}
+	ulen := int(buf[1])
+	if ulen == 0 {
+		conn.Write([]byte{socksAuthVer, socksAuthFailure})
+		return errAuth
+	}
+	if _, err := io.ReadFull(conn, buf[2:2+ulen+1]); err != nil {
+		return err
+	}
+	user := string(buf[2 : 2+ulen])
+	plen := int(buf[2+ulen])
+	passwd := buf[3+ulen : 3+ulen+plen]
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return err
+	}
+
+	want, ok := socksUsers[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), passwd) != 1 {
+		log.Printf("socks authentication failed for user %q from %v\n", user, conn.RemoteAddr())
+		conn.Write([]byte{socksAuthVer, socksAuthFailure})
+		return errAuth
+	}
+	_, err := conn.Write([]byte{socksAuthVer, socksAuthSuccess})
+	return err
+}
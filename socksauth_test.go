@@ -0,0 +1,139 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withSocksUsers sets the socks users for one test
+func withSocksUsers(t *testing.T, users map[string]string) {
+	saved := socksUsers
+	socksUsers = users
+	t.Cleanup(func() { socksUsers = saved })
+}
+
+func TestParseSocksUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := ioutil.WriteFile(path, []byte(`{"server": "127.0.0.1", "socks_users": {"alice": "secret"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := parseSocksUsers(path)
+	if err != nil || len(users) != 1 || users["alice"] != "secret" {
+		t.Errorf("parseSocksUsers() = %v, %v", users, err)
+	}
+	if _, err := parseSocksUsers(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("parseSocksUsers() read a missing file")
+	}
+}
+
+// socksExchange writes req on a pipe served by serve and returns what the
+// server answered and the error serve returned
+func socksExchange(t *testing.T, req []byte, serve func(conn net.Conn) error) ([]byte, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(server)
+		server.Close()
+	}()
+	go client.Write(req)
+	reply, _ := ioutil.ReadAll(client)
+	return reply, <-errc
+}
+
+func TestSelectMethod(t *testing.T) {
+	withSocksUsers(t, nil)
+	reply, err := socksExchange(t, nil, func(conn net.Conn) error {
+		_, err := selectMethod(conn, []byte{socksMethodPassword, socksMethodNone})
+		return err
+	})
+	if err != nil || !bytes.Equal(reply, []byte{socksVer5, socksMethodNone}) {
+		t.Errorf("without users: %v, %v", reply, err)
+	}
+
+	withSocksUsers(t, map[string]string{"alice": "secret"})
+	reply, err = socksExchange(t, nil, func(conn net.Conn) error {
+		_, err := selectMethod(conn, []byte{socksMethodNone})
+		return err
+	})
+	if err != errNoMethod || !bytes.Equal(reply, []byte{socksVer5, socksNoAcceptable}) {
+		t.Errorf("no password offered: %v, %v", reply, err)
+	}
+}
+
+func authRequest(user, passwd string) []byte {
+	req := []byte{socksAuthVer, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(passwd)))
+	return append(req, passwd...)
+}
+
+func TestPasswordAuth(t *testing.T) {
+	withSocksUsers(t, map[string]string{"alice": "secret"})
+	for _, c := range []struct {
+		name string
+		req  []byte
+		err  error
+	}{
+		{"good", authRequest("alice", "secret"), nil},
+		{"bad password", authRequest("alice", "guess"), errAuth},
+		{"unknown user", authRequest("bob", "secret"), errAuth},
+		{"empty user", authRequest("", "secret"), errAuth},
+		{"version", append([]byte{5}, authRequest("alice", "secret")[1:]...), errAuthVer},
+	} {
+		reply, err := socksExchange(t, c.req, passwordAuth)
+		if err != c.err {
+			t.Errorf("%s: passwordAuth() = %v, want %v", c.name, err, c.err)
+		}
+		want := []byte{socksAuthVer, socksAuthSuccess}
+		if c.err == errAuth {
+			want[1] = socksAuthFailure
+		} else if c.err != nil {
+			want = nil
+		}
+		if !bytes.Equal(reply, want) {
+			t.Errorf("%s: reply %v, want %v", c.name, reply, want)
+		}
+	}
+}
+
+func TestPasswordAuthTruncated(t *testing.T) {
+	withSocksUsers(t, map[string]string{"alice": "secret"})
+	req := authRequest("alice", "secret")
+	if err := passwordAuth(headerConn(t, req[:len(req)-2])); err != io.ErrUnexpectedEOF && err != io.EOF {
+		t.Errorf("passwordAuth() = %v on a short request", err)
+	}
+}
+
+func TestSocksCredential(t *testing.T) {
+	withSocksUsers(t, nil)
+	if _, _, ok := socksCredential(); ok {
+		t.Error("a credential without socks users")
+	}
+	withSocksUsers(t, map[string]string{"bob": "b", "alice": "secret", "carol": "c"})
+	if user, passwd, ok := socksCredential(); user != "alice" || passwd != "secret" || !ok {
+		t.Errorf("socksCredential() = %q, %q, %v", user, passwd, ok)
+	}
+}
+
+// the http proxy chains to a socks listener that wants a user
+func TestDialSocksPassword(t *testing.T) {
+	withDirectServer(t)
+	withSocksUsers(t, map[string]string{"alice": "secret"})
+	setSocksUpstream(mixedListener(t))
+	defer setSocksUpstream("127.0.0.1:1080")
+
+	conn, err := dialSocks(tcpEchoServer(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expectEcho(t, conn, conn)
+}
@@ -0,0 +1,121 @@
+package kcp
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 BIND, RFC 1928 section 4. Only direct outbound: the listening
+// socket is opened on this host and the peer connects to it straight, not
+// through the shadowsocks server.
+
+const socksBindTimeout = 2 * time.Minute
+
+// socksReply builds a reply with rep and a bound address, ipv4 0.0.0.0:0 if
+// addr is not an ip address
+func socksReply(rep byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	buf := []byte{socksVer5, rep, 0x00}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		buf = append(append(buf, socksAtypIPv4), ip4...)
+	} else {
+		buf = append(append(buf, socksAtypIPv6), ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// bindAddr is the local address the peer should reach: the source address
+// towards the peer, or the address the client came in on
+func bindAddr(conn net.Conn, addr string) net.IP {
+	if probe, err := net.Dial("udp", addr); err == nil {
+		defer probe.Close()
+		return probe.LocalAddr().(*net.UDPAddr).IP
+	}
+	if a, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
+
+// peerMatches reports whether an incoming connection comes from the host of
+// the BIND request, any host is fine for an unspecified address
+func peerMatches(peer net.Addr, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	tcp, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsUnspecified() || ip.Equal(tcp.IP)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// doBindSocket listens for the connection the peer at addr will make, sends
+// the first reply with the listening address and the second with the peer's
+// one once it connects, then relays
+func doBindSocket(conn net.Conn, addr string) {
+	ip := bindAddr(conn, addr)
+	network := "tcp4"
+	if ip != nil && ip.To4() == nil {
+		network = "tcp6"
+	}
+	ln, err := net.ListenTCP(network, &net.TCPAddr{IP: ip})
+	if err != nil {
+		log.Println("socks bind:", err)
+		conn.Write(errorReplySocks5(socksRepFailure))
+		return
+	}
+	defer ln.Close()
+	// keep the listener out of the vpn, the peer connects from outside
+	SendMsg(strconv.Itoa(socketFd(ln)))
+	log.Println("socks bind: listening on", ln.Addr(), "for", addr)
+	if _, err := conn.Write(socksReply(socksRepSucceeded, ln.Addr())); err != nil {
+		return
+	}
+
+	ln.SetDeadline(time.Now().Add(socksBindTimeout))
+	for {
+		peer, err := ln.AcceptTCP()
+		if err != nil {
+			log.Println("socks bind:", err)
+			conn.Write(errorReplySocks5(socksRepTTLExpired))
+			return
+		}
+		if !peerMatches(peer.RemoteAddr(), addr) {
+			log.Println("socks bind: unexpected peer", peer.RemoteAddr(), "for", addr)
+			peer.Close()
+			continue
+		}
+		if _, err := conn.Write(socksReply(socksRepSucceeded, peer.RemoteAddr())); err != nil {
+			peer.Close()
+			return
+		}
+		handleClient(conn, peer)
+		return
+	}
+}
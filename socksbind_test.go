@@ -0,0 +1,113 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocksReply(t *testing.T) {
+	for _, c := range []struct {
+		addr net.Addr
+		want []byte
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}, []byte{5, 0, 0, socksAtypIPv4, 192, 0, 2, 1, 4, 56}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, append(append([]byte{5, 0, 0, socksAtypIPv6}, net.ParseIP("2001:db8::1")...), 0, 53)},
+		{&net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, []byte{5, 0, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}},
+	} {
+		if got := socksReply(0, c.addr); !bytes.Equal(got, c.want) {
+			t.Errorf("socksReply(%v) = %v, want %v", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestPeerMatches(t *testing.T) {
+	peer := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9":   true,
+		"0.0.0.0:0":     true,
+		"192.0.2.1:9":   false,
+		"localhost:9":   true,
+		"no port":       false,
+		"[2001:db8::1]": false,
+	} {
+		if got := peerMatches(peer, addr); got != want {
+			t.Errorf("peerMatches(%v, %q) = %v, want %v", peer, addr, got, want)
+		}
+	}
+	if peerMatches(&net.UDPAddr{IP: peer.IP}, "127.0.0.1:9") {
+		t.Error("a udp peer matched")
+	}
+}
+
+// bindRequest runs doBindSocket for addr and returns the client end and the
+// listening address it reported
+func bindRequest(t *testing.T, addr string) (net.Conn, *net.TCPAddr) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go doBindSocket(server, addr)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 || reply[3] != socksAtypIPv4 {
+		t.Fatalf("first reply %v", reply)
+	}
+	return client, &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+}
+
+func TestBindSocket(t *testing.T) {
+	client, ln := bindRequest(t, "127.0.0.1:9")
+	peer, err := net.DialTCP("tcp4", nil, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	want := socksReply(0, peer.LocalAddr())
+	if !bytes.Equal(reply, want) {
+		t.Errorf("second reply %v, want the peer's address %v", reply, want)
+	}
+
+	buf := make([]byte, 4)
+	peer.Write([]byte("ping"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("client read %q, %v", buf, err)
+	}
+	client.Write([]byte("pong"))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("peer read %q, %v", buf, err)
+	}
+}
+
+// a connection from another host is turned away and the bind keeps waiting
+func TestBindSocketUnexpectedPeer(t *testing.T) {
+	client, ln := bindRequest(t, "127.0.0.2:9")
+	peer, err := net.DialTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("unexpected peer read %v, want it closed", err)
+	}
+
+	expected, err := net.DialTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}, ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0 {
+		t.Errorf("second reply %v, %v", reply, err)
+	}
+}
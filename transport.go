@@ -0,0 +1,445 @@
+package kcp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+	"golang.org/x/net/websocket"
+)
+
+// Stream transports for networks that drop udp or only let http through,
+// they carry the same smux and compression stack as kcp over cryptConn, so
+// they are encrypted with the kcp key and a server only serves clients that
+// know it. "tls" and "wss" add tls on top.
+const (
+	transportKCP = "kcp"
+	transportTCP = "tcp"
+	transportTLS = "tls"
+	transportWS  = "ws"
+	transportWSS = "wss"
+)
+
+const dialTimeout = 10 * time.Second
+
+func checkTransport(transport string) error {
+	switch transport {
+	case transportTCP, transportTLS, transportWS, transportWSS:
+		return nil
+	}
+	return errors.Errorf("unknown transport %q", transport)
+}
+
+func checkTransports(config *Config) error {
+	if config.Transport != transportKCP {
+		if err := checkTransport(config.Transport); err != nil {
+			return err
+		}
+	}
+	if config.Fallback != "" {
+		if err := checkTransport(config.Fallback); err != nil {
+			return errors.Wrap(err, "fallback")
+		}
+		if config.FallbackAfter <= 0 {
+			return errors.New("fallbackafter must be positive")
+		}
+		if config.FallbackRetry <= 0 {
+			return errors.New("fallbackretry must be positive")
+		}
+		if _, _, err := splitHostPort(fallbackAddr(config)); err != nil {
+			return err
+		}
+	}
+	if config.HTTPProxy != "" {
+		if _, err := url.Parse(config.HTTPProxy); err != nil {
+			return errors.Wrap(err, "httpproxy")
+		}
+	}
+	return nil
+}
+
+// fallbackState counts failed kcp attempts in a row: sessions the server
+// didn't answer the probe on and sessions smux closed for missed keepalives.
+// An answered probe starts over. Falling back, kcp gets another try every
+// retry.
+type fallbackState struct {
+	after   int // 0 without a fallback
+	retry   time.Duration
+	fails   int
+	retryAt time.Time
+}
+
+func newFallbackState(config *Config) *fallbackState {
+	f := &fallbackState{retry: time.Duration(config.FallbackRetry) * time.Second}
+	if config.Fallback != "" {
+		f.after = config.FallbackAfter
+	}
+	return f
+}
+
+func (f *fallbackState) active() bool {
+	return f.after > 0 && f.fails >= f.after
+}
+
+// failed notes a failed kcp attempt at now, true if it starts the fallback
+func (f *fallbackState) failed(now time.Time) bool {
+	f.fails++
+	if !f.active() {
+		return false
+	}
+	f.retryAt = now.Add(f.retry)
+	return f.fails == f.after
+}
+
+// answered notes an answered probe, true if it ends the fallback
+func (f *fallbackState) answered() bool {
+	wasActive := f.active()
+	f.fails = 0
+	return wasActive
+}
+
+// skipKCP tells whether to go straight to the fallback at now
+func (f *fallbackState) skipKCP(now time.Time) bool {
+	return f.active() && now.Before(f.retryAt)
+}
+
+// transportAddr is the host and first port of RemoteAddr, stream transports
+// don't hop
+func transportAddr(config *Config) string {
+	remote, err := parseRemoteAddr(config.RemoteAddr)
+	if err != nil {
+		return config.RemoteAddr
+	}
+	return net.JoinHostPort(remote.host, strconv.Itoa(remote.minPort))
+}
+
+// fallbackAddr defaults to transportAddr
+func fallbackAddr(config *Config) string {
+	if config.FallbackAddr != "" {
+		return config.FallbackAddr
+	}
+	return transportAddr(config)
+}
+
+// clientTLSConfig verifies the server as host, which may carry a port
+func clientTLSConfig(config *Config, host string) (*tls.Config, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.TLSInsecure,
+	}
+	if config.TLSServerName != "" {
+		tlsConfig.ServerName = config.TLSServerName
+	}
+	if config.TLSCA != "" {
+		pem, err := ioutil.ReadFile(config.TLSCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "clientTLSConfig()")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("clientTLSConfig(): no certificate in %s", config.TLSCA)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// protectSocket hands the socket to the vpn service through SendMsg before
+// it connects, like the kcp fd, so it doesn't loop back into the tunnel
+func protectSocket(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		SendMsg(strconv.Itoa(int(fd)))
+	})
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// already hold some of its bytes
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// largest frame of a cryptConn, the length field is 16 bits
+const maxCryptFrame = 65535
+
+var errBadFrame = errors.New("stream frame fails the checksum, wrong key")
+
+// cryptConn frames a stream like kcp-go frames a packet: a 2 byte length,
+// then nonce, crc32 and data encrypted together with a kcp block crypt. The
+// first frame read picks the key among blocks, the first key is sent with
+// until then. A frame no key opens ends the connection.
+type cryptConn struct {
+	net.Conn
+	blocks []kcp.BlockCrypt
+
+	rlock   sync.Mutex
+	fbuf    []byte // the frame as read
+	rbuf    []byte // the frame decrypted
+	pending []byte // decrypted data not read yet
+
+	wlock sync.Mutex
+	wbuf  []byte
+
+	block     kcp.BlockCrypt
+	blockLock sync.Mutex
+}
+
+func newCryptConn(conn net.Conn, blocks []kcp.BlockCrypt) *cryptConn {
+	return &cryptConn{
+		Conn:   conn,
+		blocks: blocks,
+		fbuf:   make([]byte, maxCryptFrame),
+		rbuf:   make([]byte, maxCryptFrame),
+		wbuf:   make([]byte, 2+maxCryptFrame),
+		block:  blocks[0],
+	}
+}
+
+// streamBlocks are the keys stream transport frames may come encrypted with,
+// the whole keyring with key rotation on
+func streamBlocks(config *Config) func() []kcp.BlockCrypt {
+	if len(config.Keys) > 0 {
+		return keyRing.list
+	}
+	block, _ := blockCryptFor(config.Crypt, config.Key)
+	blocks := []kcp.BlockCrypt{block}
+	return func() []kcp.BlockCrypt { return blocks }
+}
+
+func (c *cryptConn) sendBlock() kcp.BlockCrypt {
+	c.blockLock.Lock()
+	defer c.blockLock.Unlock()
+	return c.block
+}
+
+func (c *cryptConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	block := c.sendBlock()
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxCryptFrame-cryptHeaderSize {
+			n = maxCryptFrame - cryptHeaderSize
+		}
+		frame := c.wbuf[2 : 2+cryptHeaderSize+n]
+		binary.BigEndian.PutUint16(c.wbuf, uint16(len(frame)))
+		if _, err := io.ReadFull(rand.Reader, frame[:nonceSize]); err != nil {
+			return written, err
+		}
+		binary.LittleEndian.PutUint32(frame[nonceSize:], crc32.ChecksumIEEE(b[:n]))
+		copy(frame[cryptHeaderSize:], b[:n])
+		block.Encrypt(frame, frame)
+		if _, err := c.Conn.Write(c.wbuf[:2+len(frame)]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// open decrypts frame in place, the first frame settles the key
+func (c *cryptConn) open(frame []byte) bool {
+	check := func(block kcp.BlockCrypt) bool {
+		block.Decrypt(c.rbuf[:len(frame)], frame)
+		return binary.LittleEndian.Uint32(c.rbuf[nonceSize:]) == crc32.ChecksumIEEE(c.rbuf[cryptHeaderSize:len(frame)])
+	}
+	c.blockLock.Lock()
+	defer c.blockLock.Unlock()
+	if c.blocks == nil {
+		return check(c.block)
+	}
+	for _, block := range c.blocks {
+		if check(block) {
+			c.block, c.blocks = block, nil
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cryptConn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	for len(c.pending) == 0 {
+		var size [2]byte
+		if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(size[:]))
+		if n < cryptHeaderSize {
+			return 0, errBadFrame
+		}
+		frame := c.fbuf[:n]
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		if !c.open(frame) {
+			return 0, errBadFrame
+		}
+		c.pending = c.rbuf[cryptHeaderSize:n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// dialHTTPProxy opens a tunnel to addr with CONNECT through the http proxy
+func dialHTTPProxy(proxy, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: dialTimeout, Control: protectSocket}
+	conn, err := dialer.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("http proxy %s: %s", u.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// dialTCP connects to addr for a stream transport, through the http proxy
+// if configured, and wraps it in tls for tlsHost unless that is empty
+func dialTCP(config *Config, addr, tlsHost string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if config.HTTPProxy != "" {
+		conn, err = dialHTTPProxy(config.HTTPProxy, addr)
+	} else {
+		dialer := net.Dialer{Timeout: dialTimeout, Control: protectSocket}
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tlsHost == "" {
+		return conn, nil
+	}
+
+	tlsConfig, err := clientTLSConfig(config, tlsHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialWebSocket upgrades conn to a binary websocket at config.WSPath, the
+// Host header is config.WSHost if set
+func dialWebSocket(config *Config, conn net.Conn, addr string, secure bool) (net.Conn, error) {
+	host := addr
+	if config.WSHost != "" {
+		host = config.WSHost
+	}
+	scheme, origin := "ws", "http"
+	if secure {
+		scheme, origin = "wss", "https"
+	}
+	path := config.WSPath
+	if path == "" {
+		path = "/"
+	}
+	wsConfig, err := websocket.NewConfig(scheme+"://"+host+path, origin+"://"+host+"/")
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialTransport opens a smux session to addr over a stream transport
+func dialTransport(config *Config, smuxConfig *smux.Config, transport, addr string) (*smux.Session, error) {
+	tlsHost := ""
+	if transport == transportTLS || transport == transportWSS {
+		tlsHost = addr
+	}
+	if transport == transportWSS && config.WSHost != "" {
+		tlsHost = config.WSHost
+	}
+	conn, err := dialTCP(config, addr, tlsHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "dialTransport()")
+	}
+	if transport == transportWS || transport == transportWSS {
+		ws, err := dialWebSocket(config, conn, addr, transport == transportWSS)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "dialTransport()")
+		}
+		conn = ws
+	}
+	session, err := smux.Client(compress(newCryptConn(conn, streamBlocks(config)()), config), smuxConfig)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "dialTransport()")
+	}
+	return session, nil
+}
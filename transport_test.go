@@ -0,0 +1,259 @@
+package kcp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"golang.org/x/net/websocket"
+)
+
+// xorBlock is a kcp.BlockCrypt for tests that doesn't depend on kcp-go's ciphers
+type xorBlock byte
+
+func (b xorBlock) Encrypt(dst, src []byte) {
+	for i := range src {
+		dst[i] = src[i] ^ byte(b)
+	}
+}
+
+func (b xorBlock) Decrypt(dst, src []byte) { b.Encrypt(dst, src) }
+
+func cryptPipe(client, server []kcp.BlockCrypt) (*cryptConn, *cryptConn) {
+	a, b := net.Pipe()
+	return newCryptConn(a, client), newCryptConn(b, server)
+}
+
+func TestCryptConnRoundTrip(t *testing.T) {
+	client, server := cryptPipe([]kcp.BlockCrypt{xorBlock(1)}, []kcp.BlockCrypt{xorBlock(1)})
+	defer client.Close()
+	defer server.Close()
+
+	// more than one frame
+	want := bytes.Repeat([]byte("0123456789"), 20000)
+	go func() {
+		if n, err := client.Write(want); n != len(want) || err != nil {
+			t.Errorf("Write() = %d, %v", n, err)
+		}
+	}()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("the data changed on the way")
+	}
+}
+
+func TestCryptConnEncrypts(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	client := newCryptConn(a, []kcp.BlockCrypt{xorBlock(0x55)})
+	defer client.Close()
+	go client.Write([]byte("secret"))
+	frame := make([]byte, 2+cryptHeaderSize+6)
+	if _, err := io.ReadFull(b, frame); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(frame, []byte("secret")) {
+		t.Error("the data went out in the clear")
+	}
+}
+
+func TestCryptConnWrongKey(t *testing.T) {
+	client, server := cryptPipe([]kcp.BlockCrypt{xorBlock(1)}, []kcp.BlockCrypt{xorBlock(2)})
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 16)); err != errBadFrame {
+		t.Errorf("Read() = %v, want errBadFrame", err)
+	}
+}
+
+func TestCryptConnPicksKey(t *testing.T) {
+	// a server with a keyring answers each client with the key it came with
+	ring := []kcp.BlockCrypt{xorBlock(1), xorBlock(2)}
+	client, server := cryptPipe([]kcp.BlockCrypt{xorBlock(2)}, ring)
+	defer client.Close()
+	defer server.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Read() = %q, %v", buf, err)
+	}
+	go server.Write([]byte("pong"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("the server answered with another key: %q, %v", buf, err)
+	}
+}
+
+func TestCheckTransportsFallback(t *testing.T) {
+	config := Config{RemoteAddr: "127.0.0.1:29900", Transport: transportKCP, Fallback: transportTCP, FallbackAfter: 3, FallbackRetry: 300}
+	if err := checkTransports(&config); err != nil {
+		t.Fatal(err)
+	}
+	config.FallbackRetry = 0
+	if err := checkTransports(&config); err == nil {
+		t.Error("checkTransports() accepted a fallback without a retry")
+	}
+}
+
+func TestFallbackState(t *testing.T) {
+	f := newFallbackState(&Config{Fallback: transportTCP, FallbackAfter: 2, FallbackRetry: 60})
+	now := time.Now()
+	if f.failed(now) || f.active() {
+		t.Fatal("falling back after one failure")
+	}
+	if !f.failed(now) || !f.active() {
+		t.Fatal("not falling back after two failures")
+	}
+	if !f.skipKCP(now.Add(59 * time.Second)) {
+		t.Error("kcp tried again before the retry")
+	}
+	if f.skipKCP(now.Add(61 * time.Second)) {
+		t.Error("kcp not tried again after the retry")
+	}
+	// a failed retry waits another round
+	if f.failed(now.Add(61*time.Second)) || !f.skipKCP(now.Add(90*time.Second)) {
+		t.Error("a failed retry didn't put kcp off")
+	}
+	if !f.answered() || f.active() {
+		t.Error("an answered probe didn't end the fallback")
+	}
+
+	// an answered probe in between starts the count over
+	f.failed(now)
+	f.answered()
+	if f.failed(now) || f.active() {
+		t.Error("failures were counted across an answered probe")
+	}
+
+	none := newFallbackState(&Config{FallbackAfter: 1})
+	none.failed(now)
+	if none.active() || none.skipKCP(now) {
+		t.Error("falling back without a fallback transport")
+	}
+}
+
+// wsEchoServer echoes binary websockets at /tunnel and reports the Host
+// header of each upgrade
+func wsEchoServer(t *testing.T) (string, chan string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/tunnel", websocket.Server{Handler: func(ws *websocket.Conn) {
+		hosts <- ws.Request().Host
+		ws.PayloadType = websocket.BinaryFrame
+		io.Copy(ws, ws)
+	}})
+	server := &http.Server{Handler: mux}
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+	return lis.Addr().String(), hosts
+}
+
+func TestDialWebSocket(t *testing.T) {
+	addr, hosts := wsEchoServer(t)
+	config := &Config{WSPath: "/tunnel", WSHost: "cdn.example.com"}
+	conn, err := dialTCP(config, addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := dialWebSocket(config, conn, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if host := <-hosts; host != "cdn.example.com" {
+		t.Errorf("Host = %q, want the wshost", host)
+	}
+
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	want := []byte{0, 1, 2, 0xff}
+	if _, err := ws.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(ws, got); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("echo = %v, %v", got, err)
+	}
+}
+
+func TestDialWebSocketWrongPath(t *testing.T) {
+	addr, _ := wsEchoServer(t)
+	config := &Config{WSPath: "/elsewhere"}
+	conn, err := dialTCP(config, addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := dialWebSocket(config, conn, addr, false); err == nil {
+		t.Error("dialWebSocket() upgraded at a path the server doesn't serve")
+	}
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	// a CONNECT proxy that wants user:pass
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		io.Copy(conn, upstream)
+	}()
+
+	conn, err := dialHTTPProxy("http://user:pass@"+proxy.Addr().String(), target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, _ := ioutil.ReadAll(conn)
+	if string(got) != "hello" {
+		t.Errorf("read %q through the proxy", got)
+	}
+}
@@ -0,0 +1,418 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS5 UDP ASSOCIATE through a shadowsocks server. The client sends to one
+// relay socket, every client address gets its own socket to the server in a
+// NAT table, so the replies on it belong to that client. Entries expire when
+// idle in both directions and all of them go with the control connection.
+
+const (
+	MAX_UDPBUF     = 64 * 1024 // a whole datagram, anything smaller truncates
+	udpNATTimeout  = 2 * time.Minute
+	otaMask        = 0x10 // shadowsocks one time auth flag in the address type
+	socksUDPHeader = 3    // rsv, rsv, frag
+	fragEnd        = 0x80 // the last fragment of a sequence
+	fragTimeout    = 5 * time.Second
+	maxUDPPayload  = 65507
+)
+
+var errUDPAddr = errors.New("socks udp address malformed")
+
+// udpServer overrides the shadowsocks server of the udp relay, for when the
+// tcp server address is the kcp tunnel which only carries tcp
+var udpServer string
+
+// parseSocksAddr parses the atyp, address and port at the start of b and
+// returns them as host:port with their length
+func parseSocksAddr(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, errUDPAddr
+	}
+	var host string
+	var n int
+	switch b[0] &^ otaMask {
+	case socksAtypIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			return "", 0, errUDPAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAtypIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			return "", 0, errUDPAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case socksAtypDomain:
+		if len(b) < 2 {
+			return "", 0, errUDPAddr
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, errUDPAddr
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, errAddrType
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n + 2, nil
+}
+
+// natEntry is the socket of one client towards its peer
+type natEntry struct {
+	conn   net.PacketConn
+	ssConn packetCipher // encrypts to the server, nil on the server side
+	last   int64        // unix nanoseconds of the latest packet
+}
+
+func (e *natEntry) touch() {
+	atomic.StoreInt64(&e.last, time.Now().UnixNano())
+}
+
+func (e *natEntry) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&e.last))
+}
+
+// natTable maps client addresses to their sockets
+type natTable struct {
+	lock    sync.Mutex
+	entries map[string]*natEntry
+	timeout time.Duration
+	closed  bool
+}
+
+func newNATTable(timeout time.Duration) *natTable {
+	return &natTable{entries: make(map[string]*natEntry), timeout: timeout}
+}
+
+// get returns the entry of key, a new one is made by dial and served by serve
+func (t *natTable) get(key string, dial func() (*natEntry, error), serve func(e *natEntry)) (*natEntry, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil, io.ErrClosedPipe
+	}
+	if e, ok := t.entries[key]; ok {
+		e.touch()
+		return e, nil
+	}
+	e, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	e.touch()
+	t.entries[key] = e
+	go func() {
+		serve(e)
+		t.remove(key, e)
+	}()
+	return e, nil
+}
+
+func (t *natTable) remove(key string, e *natEntry) {
+	t.lock.Lock()
+	if t.entries[key] == e {
+		delete(t.entries, key)
+	}
+	t.lock.Unlock()
+	e.conn.Close()
+}
+
+func (t *natTable) close() {
+	t.lock.Lock()
+	t.closed = true
+	entries := t.entries
+	t.entries = make(map[string]*natEntry)
+	t.lock.Unlock()
+	for _, e := range entries {
+		e.conn.Close()
+	}
+}
+
+// readLoop hands the packets arriving on e to handle until e has been idle
+// for the table timeout or its socket fails
+func (t *natTable) readLoop(e *natEntry, handle func(b []byte, src net.Addr)) {
+	buf := make([]byte, MAX_UDPBUF)
+	for {
+		e.conn.SetReadDeadline(time.Now().Add(t.timeout))
+		n, src, err := e.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && e.idle() < t.timeout {
+				continue
+			}
+			return
+		}
+		e.touch()
+		handle(buf[:n], src)
+	}
+}
+
+// fragQueue reassembles fragmented socks datagrams, RFC 1928 section 7.
+// Fragments must come in order from 1, anything else, a different
+// destination or a 5 second pause throws the sequence away.
+type fragQueue struct {
+	addr     []byte // atyp, address and port of the sequence
+	data     []byte
+	highest  byte
+	deadline time.Time
+}
+
+func (q *fragQueue) reset() {
+	q.addr, q.data, q.highest = nil, nil, 0
+}
+
+// add queues a fragment, the whole datagram as address followed by data is
+// returned once the end fragment arrives
+func (q *fragQueue) add(frag byte, addr, data []byte) ([]byte, bool) {
+	pos := frag &^ fragEnd
+	now := time.Now()
+	if q.highest > 0 && now.After(q.deadline) {
+		q.reset()
+	}
+	switch {
+	case pos == 0:
+		q.reset()
+		return nil, false
+	case q.highest > 0 && pos == q.highest:
+		return nil, false // duplicate
+	case pos != q.highest+1 || (q.highest > 0 && !bytes.Equal(addr, q.addr)):
+		// lower than processed, a gap or another destination
+		q.reset()
+		return nil, false
+	}
+	if len(q.data)+len(data) > maxUDPPayload {
+		q.reset()
+		return nil, false
+	}
+	if q.highest == 0 {
+		q.addr = append([]byte(nil), addr...)
+	}
+	q.data = append(q.data, data...)
+	q.highest = pos
+	q.deadline = now.Add(fragTimeout)
+	if frag&fragEnd == 0 {
+		return nil, false
+	}
+	whole := append(q.addr, q.data...)
+	q.reset()
+	return whole, true
+}
+
+// pickUDPServer returns the server with the fewest recent failures
+func pickUDPServer() int {
+	best := 0
+	for i := range servers.srvCipher {
+		if failCount(i) < failCount(best) {
+			best = i
+		}
+	}
+	return best
+}
+
+func doUdpSocket(conn net.Conn, rawaddr []byte, addr string, closed bool) {
+	se := servers.srvCipher[pickUDPServer()]
+	server := se.server
+	if udpServer != "" {
+		server = udpServer
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		log.Println("udp relay:", err)
+		conn.Write(socksReply(socksRepHostUnreachable, nil))
+		return
+	}
+
+	// the relay socket sits on the address the client reached us on, and
+	// only takes datagrams from the host at the other end of the tcp
+	// connection, not the client a PROXY header reports
+	tcpConn := rawConn(conn)
+	localIP := net.IPv4(127, 0, 0, 1)
+	if a, ok := tcpConn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = a.IP
+	}
+	var clientIP net.IP
+	if a, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = a.IP
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("failed to ListenUDP: %v\n", err)
+		conn.Write(socksReply(socksRepFailure, nil))
+		return
+	}
+	defer relay.Close()
+	if _, err := conn.Write(socksReply(socksRepSucceeded, relay.LocalAddr())); err != nil {
+		return
+	}
+	log.Println("udp relay:", relay.LocalAddr(), "for", conn.RemoteAddr(), "via", server)
+	if tc, ok := tcpConn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(15 * time.Second)
+	}
+	conn.SetDeadline(time.Time{})
+
+	nat := newNATTable(udpNATTimeout)
+	defer nat.close()
+	go relayUDP(relay, clientIP, serverAddr, se.cipher, nat)
+
+	// the association lasts as long as the control connection
+	io.Copy(ioutil.Discard, conn)
+}
+
+// relayUDP forwards the datagrams of the client to the server, each client
+// address through its own entry of nat
+func relayUDP(relay *net.UDPConn, clientIP net.IP, serverAddr *net.UDPAddr, cipher ssCipher, nat *natTable) {
+	buf := make([]byte, MAX_UDPBUF)
+	var frags fragQueue
+	for {
+		n, src, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			if !isUseOfClosedConn(err) {
+				log.Println("udp relay read:", err)
+			}
+			return
+		}
+		if clientIP != nil && !clientIP.Equal(src.IP) {
+			continue
+		}
+		pkt := buf[:n]
+		if len(pkt) < socksUDPHeader || pkt[0] != 0 || pkt[1] != 0 {
+			continue
+		}
+		dst, hlen, err := parseSocksAddr(pkt[socksUDPHeader:])
+		if err != nil {
+			continue
+		}
+		// the shadowsocks payload is the socks datagram without rsv and frag
+		payload := pkt[socksUDPHeader:]
+		if frag := pkt[2]; frag != 0 {
+			whole, ok := frags.add(frag, payload[:hlen], payload[hlen:])
+			if !ok {
+				continue
+			}
+			payload = whole
+		} else {
+			// a standalone datagram ends any sequence in progress
+			frags.reset()
+		}
+		if pkt[socksUDPHeader] == socksAtypDomain {
+			if host, _, _ := net.SplitHostPort(dst); isBlockDomain(host) {
+				continue
+			}
+		}
+
+		client := *src
+		e, err := nat.get(src.String(), func() (*natEntry, error) {
+			return dialUDPServer(cipher)
+		}, func(e *natEntry) {
+			nat.readLoop(e, func(b []byte, _ net.Addr) { replyUDP(relay, &client, e, b) })
+		})
+		if err != nil {
+			log.Println("udp relay:", err)
+			continue
+		}
+		if _, err := e.ssConn.WriteTo(payload, serverAddr); err != nil {
+			log.Println("udp relay write:", err)
+			continue
+		}
+		udpRelayPackets.inc(labels("component", "udp", "direction", "up"))
+	}
+}
+
+// dialUDPServer opens a protected socket to the shadowsocks server
+func dialUDPServer(cipher ssCipher) (*natEntry, error) {
+	udpconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	SendMsg(strconv.Itoa(socketFd(udpconn)))
+	var pc net.PacketConn = udpconn
+	if udpNetem != nil {
+		pc = newNetemConn(udpconn, udpNetem)
+	}
+	return &natEntry{
+		conn:   pc,
+		ssConn: cipher.packetConn(pc, true), // force OTA on stream ciphers
+	}, nil
+}
+
+// serveShadowsocksUDP is a stand-in shadowsocks udp server for testing the
+// relay locally, it forwards to the targets in the datagrams and encrypts
+// their replies back
+func serveShadowsocksUDP(conn net.PacketConn, cipher ssCipher) {
+	ssConn := cipher.packetConn(conn, false)
+	nat := newNATTable(udpNATTimeout)
+	defer nat.close()
+	buf := make([]byte, MAX_UDPBUF)
+	for {
+		n, src, err := ssConn.ReadFrom(buf)
+		if err != nil {
+			if isUseOfClosedConn(err) {
+				return
+			}
+			continue
+		}
+		dst, hlen, err := parseSocksAddr(buf[:n])
+		if err != nil {
+			continue
+		}
+		target, err := net.ResolveUDPAddr("udp", dst)
+		if err != nil {
+			log.Println("shadowsocks udp:", err)
+			continue
+		}
+
+		client := src
+		e, err := nat.get(src.String(), func() (*natEntry, error) {
+			pc, err := net.ListenPacket("udp", "")
+			if err != nil {
+				return nil, err
+			}
+			return &natEntry{conn: pc}, nil
+		}, func(e *natEntry) {
+			nat.readLoop(e, func(b []byte, from net.Addr) {
+				if raw, err := hostRawAddr(from.String()); err == nil {
+					ssConn.WriteTo(append(raw, b...), client)
+				}
+			})
+		})
+		if err != nil {
+			log.Println("shadowsocks udp:", err)
+			continue
+		}
+		e.conn.WriteTo(buf[hlen:n], target)
+	}
+}
+
+// replyUDP decrypts a datagram from the server and sends it to the client
+// with the socks header of its source
+func replyUDP(relay *net.UDPConn, client *net.UDPAddr, e *natEntry, b []byte) {
+	plain, err := e.ssConn.open(b)
+	if err != nil {
+		return
+	}
+	if _, _, err := parseSocksAddr(plain); err != nil {
+		return
+	}
+	data := append([]byte{0, 0, 0}, plain...)
+	data[socksUDPHeader] &^= otaMask
+	if _, err := relay.WriteToUDP(data, client); err != nil {
+		log.Println("udp relay reply:", err)
+		return
+	}
+	udpRelayPackets.inc(labels("component", "udp", "direction", "down"))
+}
@@ -0,0 +1,336 @@
+package kcp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingEcho is a udp echo server that keeps the source of every datagram
+type recordingEcho struct {
+	net.PacketConn
+	lock    sync.Mutex
+	sources []string
+}
+
+func newRecordingEcho(t *testing.T) *recordingEcho {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	e := &recordingEcho{PacketConn: pc}
+	go func() {
+		buf := make([]byte, MAX_UDPBUF)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			e.lock.Lock()
+			e.sources = append(e.sources, addr.String())
+			e.lock.Unlock()
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return e
+}
+
+func (e *recordingEcho) seen() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string(nil), e.sources...)
+}
+
+// udpAssociate starts serveShadowsocksUDP and a UDP ASSOCIATE on conn, it
+// returns the relay address
+func udpAssociate(t *testing.T, conn func() (client, server net.Conn)) *net.UDPAddr {
+	cipher, err := newCipher("aes-128-gcm", "udp relay test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ssConn.Close() })
+	go serveShadowsocksUDP(ssConn, cipher)
+
+	saved := servers.srvCipher
+	servers.srvCipher = []*ServerCipher{{ssConn.LocalAddr().String(), cipher}}
+	servers.failCnt = make([]int, 1)
+	t.Cleanup(func() { servers.srvCipher, servers.failCnt = saved, make([]int, len(saved)) })
+
+	client, server := conn()
+	t.Cleanup(func() { client.Close() })
+	go doUdpSocket(server, nil, "", false)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socksRepSucceeded {
+		t.Fatalf("reply %v", reply)
+	}
+	return &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+}
+
+// tcpPair is a connected pair of loopback tcp connections
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func socksDatagram(dst net.Addr, data []byte) []byte {
+	a := dst.(*net.UDPAddr)
+	b := append([]byte{0, 0, 0, socksAtypIPv4}, a.IP.To4()...)
+	b = append(b, byte(a.Port>>8), byte(a.Port))
+	return append(b, data...)
+}
+
+// udpRoundTrip sends data to dst through the relay and checks the reply
+// carries it back with dst in the header
+func udpRoundTrip(t *testing.T, client net.PacketConn, relay, dst net.Addr, data []byte) {
+	t.Helper()
+	if _, err := client.WriteTo(socksDatagram(dst, data), relay); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MAX_UDPBUF)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := socksDatagram(dst, data); !bytes.Equal(buf[:n], want) {
+		t.Errorf("reply of %d bytes from %v, want %d", n, dst, len(want))
+	}
+}
+
+func udpClient(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestUDPRelay(t *testing.T) {
+	relay := udpAssociate(t, func() (net.Conn, net.Conn) { return tcpPair(t) })
+	echo1, echo2 := newRecordingEcho(t), newRecordingEcho(t)
+
+	client := udpClient(t)
+	udpRoundTrip(t, client, relay, echo1.LocalAddr(), []byte("one"))
+	udpRoundTrip(t, client, relay, echo2.LocalAddr(), []byte("two"))
+	udpRoundTrip(t, client, relay, echo1.LocalAddr(), []byte("three"))
+	// one client goes out through one socket to any destination
+	if s1, s2 := echo1.seen(), echo2.seen(); len(s1) != 2 || s1[0] != s1[1] || s2[0] != s1[0] {
+		t.Errorf("sources %v and %v, want one nat entry", s1, s2)
+	}
+
+	other := udpClient(t)
+	udpRoundTrip(t, other, relay, echo1.LocalAddr(), []byte("four"))
+	if s1 := echo1.seen(); s1[2] == s1[0] {
+		t.Error("two clients share a nat entry")
+	}
+
+	// close to the largest datagram
+	udpRoundTrip(t, client, relay, echo2.LocalAddr(), bytes.Repeat([]byte("x"), 60000))
+}
+
+// the source check is against the load balancer the tcp connection comes
+// from, not the client in its PROXY header
+func TestUDPRelayBehindProxy(t *testing.T) {
+	relay := udpAssociate(t, func() (net.Conn, net.Conn) {
+		client, server := tcpPair(t)
+		return client, &proxyConn{&bufferedConn{server, bufio.NewReader(server)}, &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}}
+	})
+	udpRoundTrip(t, udpClient(t), relay, newRecordingEcho(t).LocalAddr(), []byte("ping"))
+}
+
+func TestUDPRelayDropsOtherHosts(t *testing.T) {
+	relay := udpAssociate(t, func() (net.Conn, net.Conn) { return tcpPair(t) })
+	echo := newRecordingEcho(t)
+	client, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer client.Close()
+	client.WriteTo(socksDatagram(echo.LocalAddr(), []byte("ping")), relay)
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadFrom(make([]byte, 64)); err == nil {
+		t.Error("the relay took a datagram from another host")
+	}
+}
+
+func TestNATTableIdleExpiry(t *testing.T) {
+	nat := newNATTable(50 * time.Millisecond)
+	defer nat.close()
+	dials := 0
+	dial := func() (*natEntry, error) {
+		dials++
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		return &natEntry{conn: pc}, nil
+	}
+	serve := func(e *natEntry) { nat.readLoop(e, func([]byte, net.Addr) {}) }
+
+	e1, err := nat.get("client", dial, serve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := nat.get("client", dial, serve); e != e1 || dials != 1 {
+		t.Fatal("an active entry wasn't reused")
+	}
+
+	// replies keep an entry alive
+	sender := udpClient(t)
+	for i := 0; i < 4; i++ {
+		sender.WriteTo([]byte("reply"), e1.conn.LocalAddr())
+		time.Sleep(20 * time.Millisecond)
+	}
+	nat.lock.Lock()
+	alive := nat.entries["client"] == e1
+	nat.lock.Unlock()
+	if !alive {
+		t.Fatal("an entry getting replies expired")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nat.lock.Lock()
+		n := len(nat.entries)
+		nat.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("an idle entry didn't expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e, _ := nat.get("client", dial, serve); e == e1 || dials != 2 {
+		t.Error("an expired entry was reused")
+	}
+}
+
+func TestNATTableClose(t *testing.T) {
+	nat := newNATTable(time.Minute)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := nat.get("client", func() (*natEntry, error) { return &natEntry{conn: pc}, nil }, func(e *natEntry) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nat.close()
+	if _, err := e.conn.WriteTo([]byte("x"), pc.LocalAddr()); err == nil {
+		t.Error("closing the table left an entry open")
+	}
+	if _, err := nat.get("client", nil, nil); err != io.ErrClosedPipe {
+		t.Errorf("get() on a closed table = %v", err)
+	}
+}
+
+func TestFragQueue(t *testing.T) {
+	addr := []byte{socksAtypIPv4, 192, 0, 2, 1, 0, 53}
+	other := []byte{socksAtypIPv4, 192, 0, 2, 2, 0, 53}
+	whole := append(append([]byte(nil), addr...), "abc"...)
+	for _, c := range []struct {
+		name  string
+		frags []byte
+		addrs [][]byte
+		want  []byte
+	}{
+		{"in order", []byte{1, 2, 3 | fragEnd}, nil, whole},
+		{"single", []byte{1 | fragEnd}, nil, append(append([]byte(nil), addr...), "a"...)},
+		{"duplicate", []byte{1, 2, 2, 3 | fragEnd}, nil, whole},
+		{"gap", []byte{1, 3 | fragEnd}, nil, nil},
+		{"not from 1", []byte{2, 3 | fragEnd}, nil, nil},
+		{"lower", []byte{1, 2, 1, 3 | fragEnd}, nil, nil},
+		{"standalone", []byte{1, 2, 0, 3 | fragEnd}, nil, nil},
+		{"another destination", []byte{1, 2, 3 | fragEnd}, [][]byte{addr, other, addr}, nil},
+	} {
+		var q fragQueue
+		var got []byte
+		for i, frag := range c.frags {
+			a := addr
+			if c.addrs != nil {
+				a = c.addrs[i]
+			}
+			data := []byte{"abc"[(frag&^fragEnd+2)%3]}
+			if b, ok := q.add(frag, a, data); ok {
+				got = b
+			}
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFragQueueTimeout(t *testing.T) {
+	addr := []byte{socksAtypIPv4, 192, 0, 2, 1, 0, 53}
+	var q fragQueue
+	q.add(1, addr, []byte("a"))
+	q.deadline = time.Now().Add(-time.Millisecond)
+	if _, ok := q.add(2|fragEnd, addr, []byte("b")); ok {
+		t.Error("a sequence was finished after the fragment timeout")
+	}
+	// the late fragment didn't start a sequence either
+	if q.highest != 0 {
+		t.Errorf("highest = %d after the timeout", q.highest)
+	}
+}
+
+func TestFragQueueTooLarge(t *testing.T) {
+	addr := []byte{socksAtypIPv4, 192, 0, 2, 1, 0, 53}
+	var q fragQueue
+	q.add(1, addr, make([]byte, maxUDPPayload-10))
+	if _, ok := q.add(2|fragEnd, addr, make([]byte, 20)); ok || q.highest != 0 {
+		t.Error("a datagram larger than udp allows was reassembled")
+	}
+}
+
+// fragments through the relay come out at the target as one datagram
+func TestUDPRelayFragments(t *testing.T) {
+	relay := udpAssociate(t, func() (net.Conn, net.Conn) { return tcpPair(t) })
+	echo := newRecordingEcho(t)
+	client := udpClient(t)
+	for i, part := range []string{"frag", "men", "ted"} {
+		pkt := socksDatagram(echo.LocalAddr(), []byte(part))
+		pkt[2] = byte(i + 1)
+		if i == 2 {
+			pkt[2] |= fragEnd
+		}
+		client.WriteTo(pkt, relay)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MAX_UDPBUF)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := socksDatagram(echo.LocalAddr(), []byte("fragmented")); !bytes.Equal(buf[:n], want) {
+		t.Errorf("reply %q, want %q", buf[:n], want)
+	}
+}
@@ -0,0 +1,134 @@
+package kcp
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Local listeners take "unix:/path" for a unix domain socket, so access can
+// be limited with the file mode and owner instead of anyone on loopback.
+
+const unixPrefix = "unix:"
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// checkLocalAddr validates a local listen address, tcp or unix
+func checkLocalAddr(addr string) error {
+	if isUnixAddr(addr) {
+		if addr == unixPrefix {
+			return errors.New("empty unix socket path")
+		}
+		return nil
+	}
+	_, _, err := splitHostPort(addr)
+	return err
+}
+
+// parseSocketMode parses an octal file mode like 0660, empty keeps the umask
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("socket mode %q is not an octal permission like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupOwner resolves user[:group] by name or number, -1 leaves an id as is
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		id := parts[0]
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(id)
+			if err != nil {
+				return 0, 0, err
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		id := parts[1]
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(id)
+			if err != nil {
+				return 0, 0, err
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	return uid, gid, nil
+}
+
+// listenLocal listens on a tcp address or on a unix socket given as
+// unix:/path, the socket gets mode and owner (user[:group]) if set. A stale
+// socket left by an earlier run is removed first. The socket is made
+// private right after it is created and only opened up once mode and owner
+// are in place.
+func listenLocal(addr, mode, owner string) (net.Listener, error) {
+	if err := checkLocalAddr(addr); err != nil {
+		return nil, err
+	}
+	if !isUnixAddr(addr) {
+		return net.Listen("tcp", addr)
+	}
+
+	perm, err := parseSocketMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return nil, errors.Wrap(err, "socket owner")
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm == 0 && uid == -1 && gid == -1 {
+		return lis, nil
+	}
+	// keep everyone else out until mode and owner are in place
+	if perm == 0 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			lis.Close()
+			return nil, errors.Wrap(err, "listenLocal()")
+		}
+		perm = fi.Mode().Perm()
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		lis.Close()
+		return nil, errors.Wrap(err, "listenLocal()")
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			lis.Close()
+			return nil, errors.Wrap(err, "listenLocal()")
+		}
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		lis.Close()
+		return nil, errors.Wrap(err, "listenLocal()")
+	}
+	return lis, nil
+}
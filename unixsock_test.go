@@ -0,0 +1,176 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestCheckLocalAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:1080":       true,
+		"[::1]:1080":           true,
+		"unix:/tmp/socks.sock": true,
+		"unix:":                false,
+		"127.0.0.1":            false,
+	} {
+		if err := checkLocalAddr(addr); (err == nil) != ok {
+			t.Errorf("checkLocalAddr(%q) = %v", addr, err)
+		}
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	if mode, err := parseSocketMode("0660"); mode != 0660 || err != nil {
+		t.Errorf("parseSocketMode() = %o, %v", mode, err)
+	}
+	if mode, err := parseSocketMode(""); mode != 0 || err != nil {
+		t.Errorf("parseSocketMode(\"\") = %o, %v", mode, err)
+	}
+	for _, s := range []string{"0999", "1777", "rw"} {
+		if _, err := parseSocketMode(s); err == nil {
+			t.Errorf("parseSocketMode(%q): no error", s)
+		}
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	if uid, gid, err := lookupOwner("1000:100"); uid != 1000 || gid != 100 || err != nil {
+		t.Errorf("lookupOwner() = %d, %d, %v", uid, gid, err)
+	}
+	if uid, gid, err := lookupOwner(":100"); uid != -1 || gid != 100 || err != nil {
+		t.Errorf("lookupOwner(:100) = %d, %d, %v", uid, gid, err)
+	}
+	if _, _, err := lookupOwner("no-such-user-here"); err == nil {
+		t.Error("lookupOwner() found a missing user")
+	}
+}
+
+func unixTestPath(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix socket file modes")
+	}
+	return filepath.Join(t.TempDir(), "socks.sock")
+}
+
+func TestListenLocalUnix(t *testing.T) {
+	path := unixTestPath(t)
+	// a stale socket of an earlier run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := stale.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+	stale.Close()
+
+	lis, err := listenLocal(unixPrefix+path, "0660", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0660 {
+		t.Errorf("socket mode = %o, want 0660", perm)
+	}
+}
+
+// an owner alone leaves the socket with the mode it was created with
+func TestListenLocalUnixOwner(t *testing.T) {
+	path := unixTestPath(t)
+	plain, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	plain.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := listenLocal(unixPrefix+path, "", ":"+strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	got, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode().Perm() != fi.Mode().Perm() {
+		t.Errorf("socket mode = %o, want %o", got.Mode().Perm(), fi.Mode().Perm())
+	}
+}
+
+func TestSetSocksUpstream(t *testing.T) {
+	defer setSocksUpstream("127.0.0.1:1080")
+	for listen, want := range map[string]string{
+		":1080":               "127.0.0.1:1080",
+		"0.0.0.0:1081":        "127.0.0.1:1081",
+		"[::]:1082":           "127.0.0.1:1082",
+		"192.0.2.1:1083":      "192.0.2.1:1083",
+		"unix:/run/socks.sck": "unix:/run/socks.sck",
+	} {
+		setSocksUpstream(listen)
+		if socksUpstream != want {
+			t.Errorf("setSocksUpstream(%q) chains to %q, want %q", listen, socksUpstream, want)
+		}
+	}
+}
+
+// fakeSocks5 answers one CONNECT on lis with a domain bound address and
+// then sends the requested address back
+func fakeSocks5(t *testing.T, lis net.Listener) {
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:3]); err != nil { // greeting
+			return
+		}
+		conn.Write([]byte{5, 0})
+		if _, err := io.ReadFull(conn, buf[:5]); err != nil { // request up to the name length
+			return
+		}
+		name := make([]byte, int(buf[4])+2)
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0, 0, socksAtypDomain, 4, 'b', 'o', 'u', 'n', 0, 80})
+		conn.Write(name)
+	}()
+}
+
+func TestDialSocksUnix(t *testing.T) {
+	path := unixTestPath(t)
+	lis, err := listenLocal(unixPrefix+path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	fakeSocks5(t, lis)
+	setSocksUpstream(unixPrefix + path)
+	defer setSocksUpstream("127.0.0.1:1080")
+
+	conn, err := dialSocks("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, _ := ioutil.ReadAll(conn)
+	if want := append([]byte("example.com"), 1, 187); !bytes.Equal(got, want) {
+		t.Errorf("after the reply read %q, want %q", got, want)
+	}
+}
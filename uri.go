@@ -0,0 +1,149 @@
+package kcp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A Config in one line for links and QR codes:
+//
+//	kcptun://<base64url key>@<remoteaddr>?crypt=aes&mode=fast&...
+//
+// Every Config field is a query parameter named by its json tag. Lists repeat
+// the parameter, other composite fields are json. The key and the keys list
+// are base64url, a remoteaddr with a port range goes in the query.
+
+const uriScheme = "kcptun"
+
+var uriEncoding = base64.RawURLEncoding
+
+// EncodeURI encodes config as a kcptun:// URI, empty strings and lists are
+// left out
+func EncodeURI(config *Config) string {
+	u := url.URL{Scheme: uriScheme, User: url.User(uriEncoding.EncodeToString([]byte(config.Key)))}
+	query := url.Values{}
+	if _, _, err := net.SplitHostPort(config.RemoteAddr); err == nil {
+		if _, err := url.Parse("//" + config.RemoteAddr); err == nil {
+			u.Host = config.RemoteAddr
+		}
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		f := v.Field(i)
+		switch {
+		case name == "" || name == "key":
+		case name == "remoteaddr" && u.Host != "":
+		case name == "keys":
+			for _, key := range config.Keys {
+				query.Add(name, uriEncoding.EncodeToString([]byte(key)))
+			}
+		case f.Kind() == reflect.String:
+			if f.String() != "" {
+				query.Set(name, f.String())
+			}
+		case f.Kind() == reflect.Int:
+			query.Set(name, strconv.FormatInt(f.Int(), 10))
+		case f.Kind() == reflect.Bool:
+			query.Set(name, strconv.FormatBool(f.Bool()))
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < f.Len(); j++ {
+				query.Add(name, f.Index(j).String())
+			}
+		case (f.Kind() == reflect.Slice || f.Kind() == reflect.Map) && f.Len() == 0:
+		default:
+			if b, err := json.Marshal(f.Interface()); err == nil {
+				query.Set(name, string(b))
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// DecodeURI sets the fields present in a kcptun:// URI on config
+func DecodeURI(uri string, config *Config) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return errors.Wrap(err, "DecodeURI()")
+	}
+	if u.Scheme != uriScheme {
+		return errors.Errorf("DecodeURI(): scheme %q, want %s", u.Scheme, uriScheme)
+	}
+	if u.User != nil {
+		key, err := uriEncoding.DecodeString(u.User.Username())
+		if err != nil {
+			return errors.Wrap(err, "DecodeURI(): key")
+		}
+		config.Key = string(key)
+	}
+	if u.Host != "" {
+		config.RemoteAddr = u.Host
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	query := u.Query()
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		values, ok := query[name]
+		if name == "" || name == "key" || !ok {
+			continue
+		}
+		if err := setField(v.Field(i), name, values); err != nil {
+			return errors.Wrap(err, "DecodeURI(): "+name)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, name string, values []string) error {
+	switch {
+	case name == "keys":
+		keys := make([]string, len(values))
+		for i, s := range values {
+			key, err := uriEncoding.DecodeString(s)
+			if err != nil {
+				return err
+			}
+			keys[i] = string(key)
+		}
+		f.Set(reflect.ValueOf(keys))
+	case f.Kind() == reflect.String:
+		f.SetString(values[0])
+	case f.Kind() == reflect.Int:
+		n, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case f.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+		f.Set(reflect.ValueOf(append([]string(nil), values...)))
+	default:
+		return json.Unmarshal([]byte(values[0]), f.Addr().Interface())
+	}
+	return nil
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,83 @@
+package kcp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestURIRoundTrip(t *testing.T) {
+	config := Config{
+		Key:        "it's a secret/+=",
+		Keys:       []string{"new key", "old key"},
+		RemoteAddr: "vps.example.com:29900",
+		Crypt:      "aes-128",
+		Mode:       "fast2",
+		Conn:       2,
+		NoComp:     true,
+		Bind:       []string{"wlan0", "rmnet0"},
+		Mappings:   []Mapping{{Local: "127.0.0.1:2222", Target: "ssh"}},
+	}
+	uri := EncodeURI(&config)
+	if !strings.HasPrefix(uri, "kcptun://") || strings.Contains(uri, "secret") {
+		t.Errorf("EncodeURI() = %s", uri)
+	}
+	var got Config
+	if err := DecodeURI(uri, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, config) {
+		t.Errorf("DecodeURI() = %+v, want %+v", got, config)
+	}
+}
+
+func TestURIPortRange(t *testing.T) {
+	config := Config{Key: "k", RemoteAddr: "vps.example.com:29900-29910"}
+	var got Config
+	if err := DecodeURI(EncodeURI(&config), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RemoteAddr != config.RemoteAddr {
+		t.Errorf("remoteaddr = %q, want %q", got.RemoteAddr, config.RemoteAddr)
+	}
+}
+
+func TestDecodeURIKeepsMissingFields(t *testing.T) {
+	config := Config{Key: "shell", Mode: "fast", SndWnd: 128}
+	if err := DecodeURI("kcptun://?mode=fast3", &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Mode != "fast3" || config.Key != "shell" || config.SndWnd != 128 {
+		t.Errorf("DecodeURI() = %+v", config)
+	}
+}
+
+func TestDecodeURIInvalid(t *testing.T) {
+	for _, uri := range []string{"http://k@host:1", "kcptun://!!@host:1", "kcptun://?conn=many", "kcptun://?nocomp=maybe"} {
+		var config Config
+		if err := DecodeURI(uri, &config); err == nil {
+			t.Errorf("DecodeURI(%q): no error", uri)
+		}
+	}
+}
+
+func TestMergeKeys(t *testing.T) {
+	for _, c := range []struct {
+		key     string
+		keys    []string
+		oldkeys []string
+		want    []string
+	}{
+		{"k", nil, nil, nil},
+		{"k", nil, []string{"old"}, []string{"k", "old"}},
+		// the json file or uri replaced the key after the flags were read
+		{"uri", nil, []string{"old"}, []string{"uri", "old"}},
+		{"k", []string{"a", "k", "b"}, []string{"old"}, []string{"k", "a", "b"}},
+	} {
+		config := Config{Key: c.key, Keys: c.keys}
+		mergeKeys(&config, c.oldkeys)
+		if !reflect.DeepEqual(config.Keys, c.want) {
+			t.Errorf("mergeKeys(%q, %q, %q) = %q, want %q", c.key, c.keys, c.oldkeys, config.Keys, c.want)
+		}
+	}
+}